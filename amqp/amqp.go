@@ -1,37 +1,70 @@
 package amqp
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/json"
+	"errors"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/HolmesProcessing/Holmes-Storage/context"
-	"github.com/HolmesProcessing/Holmes-Storage/dataStorage"
+	"github.com/HolmesProcessing/Holmes-Storage/ingest"
 
 	"github.com/streadway/amqp"
 )
 
-type totemResult struct {
-	Filename string   `json:"filename"`
-	Data     string   `json:"data"`
-	Tags     []string `json:"tags"`
-	MD5      string   `json:"md5"`
-	SHA1     string   `json:"sha1"`
-	SHA256   string   `json:"sha256"`
+// Consumer is the ingestion source receiving the results from the
+// configured AMQP queue.
+type Consumer struct {
+	lock  sync.Mutex
+	state string
 }
 
-func Start(c *context.Ctx) {
+const (
+	consumerConnecting = "connecting"
+	consumerConsuming  = "consuming"
+	consumerPaused     = "paused"
+	consumerStopped    = "stopped"
+)
+
+func (a *Consumer) Name() string {
+	return "amqp"
+}
+
+func (a *Consumer) setState(state string) {
+	a.lock.Lock()
+	a.state = state
+	a.lock.Unlock()
+}
+
+// Ping fails unless the consumer is subscribed to the queue. A consumer
+// paused because of a failing storage counts as healthy.
+func (a *Consumer) Ping() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	switch a.state {
+	case consumerConsuming, consumerPaused:
+		return nil
+	case "":
+		return errors.New("AMQP consumer isn't started")
+	}
+
+	return errors.New("AMQP consumer is " + a.state)
+}
+
+func (a *Consumer) Run(c *context.Ctx) error {
+	a.setState(consumerConnecting)
+	defer a.setState(consumerStopped)
+
 	// listen on AMQP queue
 	amqpConn, err := amqp.Dial(c.Config.AMQP)
 	if err != nil {
-		c.Warning.Panicln("Contacting the AMQP server failed with", err.Error())
+		return errors.New("Contacting the AMQP server failed with " + err.Error())
 	}
+	defer amqpConn.Close()
 
 	channel, err := amqpConn.Channel()
 	if err != nil {
-		c.Warning.Panicln("Initializing AMQP channel failed with", err.Error())
+		return errors.New("Initializing AMQP channel failed with " + err.Error())
 	}
 
 	_, err = channel.QueueDeclare(
@@ -43,122 +76,116 @@ func Start(c *context.Ctx) {
 		nil,            // arguments
 	)
 	if err != nil {
-		c.Warning.Panicln("Declaring queue failed with", err.Error())
+		return errors.New("Declaring queue failed with " + err.Error())
 	}
 
-	err = channel.Qos(
-		c.Config.PrefetchCount, // prefetch count
-		0,     // prefetch size
-		false, // global
-	)
-	if err != nil {
-		c.Warning.Panicln("Setting QoS failed with", err.Error())
+	// the consumer tag is needed to cancel the consumer when pausing
+	consumer := c.Config.RoutingKey
+	if consumer == "" {
+		consumer = "holmes-storage"
 	}
 
-	msgs, err := channel.Consume(
-		c.Config.Queue,      // queue
-		c.Config.RoutingKey, // consumer
-		false,               // auto-ack
-		false,               // exclusive
-		false,               // no-local
-		false,               // no-wait
-		nil,                 // args
-	)
-	if err != nil {
-		c.Warning.Panicln("Channel consume failed with", err.Error())
-	}
-
-	forever := make(chan bool)
-	go func() {
-		for m := range msgs {
-			c.Info.Println("Received new message")
-			handleMessage(c, m)
+	state := ingest.StateRunning
+	for {
+		// the prefetch count only applies to consumers created after it
+		// was set, so the consumer is restarted whenever it changes
+		err = channel.Qos(
+			prefetch(c, state), // prefetch count
+			0,                  // prefetch size
+			false,              // global
+		)
+		if err != nil {
+			return errors.New("Setting QoS failed with " + err.Error())
 		}
-	}()
-	<-forever
-}
-
-func handleMessage(c *context.Ctx, msg amqp.Delivery) {
-	c.Debug.Println("Msg:", string(msg.Body))
 
-	m := &totemResult{}
-	err := json.Unmarshal(msg.Body, m)
-	if err != nil {
-		c.Warning.Printf("Could not decode msg: %s\n", msg.Body)
-		msg.Nack(false, false)
-		return
-	}
-
-	/*
-		// This approach has been revised since the data is now
-		// saved as string and not as pure JSON document.
-
-		// since totem sends the results as json encoded string
-		// (which contains json) we need to unmarshal data
-		// and save it this way.
-		var resData interface{}
-		err = json.Unmarshal([]byte(m.Data), &resData)
+		msgs, err := channel.Consume(
+			c.Config.Queue, // queue
+			consumer,       // consumer
+			false,          // auto-ack
+			false,          // exclusive
+			false,          // no-local
+			false,          // no-wait
+			nil,            // args
+		)
 		if err != nil {
-			warning.Printf("Could not decode data: %s\n", m.Data)
-			msg.Nack(false, false)
-			return
+			return errors.New("Channel consume failed with " + err.Error())
 		}
-	*/
+		a.setState(consumerConsuming)
 
-	// TODO: Add validation to received msg
-	//m.Validate()
+		cancelled := false
+		for m := range msgs {
+			if cancelled {
+				// deliveries which were already in flight when the
+				// consumer got cancelled go straight back to the queue
+				m.Nack(false, true)
+				continue
+			}
 
-	// TODO: Totem needs to send more data
+			c.Info.Println("Received new message")
+			handleMessage(c, m)
 
-	// TODO: Totem needs to send hashes lowercase
+			if next := ingest.State(); next != state {
+				if cancelled, err = applyPressure(c, channel, consumer, state, next); err != nil {
+					return err
+				}
+				state = next
+			}
+		}
 
-	// TODO: Totem needs to send execution time
+		if !cancelled {
+			return errors.New("AMQP channel was closed")
+		}
 
-	// compress results using gzip
-	var resultsGZ bytes.Buffer
-	gz := gzip.NewWriter(&resultsGZ)
-	if _, err := gz.Write([]byte(m.Data)); err != nil {
-		c.Warning.Println("Failed to compress results (writer):", err.Error(), "SHA256:", m.SHA256)
-		msg.Nack(false, true)
-		return
+		if state == ingest.StatePaused {
+			a.setState(consumerPaused)
+			ingest.Pressure.Wait()
+			c.Info.Println("Resuming AMQP consumer")
+			state = ingest.State()
+		}
 	}
+}
 
-	if err := gz.Flush(); err != nil {
-		c.Warning.Println("Failed to compress results (flush):", err.Error(), "SHA256:", m.SHA256)
-		msg.Nack(false, true)
-		return
+// prefetch returns the prefetch count of the consumer in a backpressure
+// state, throttling lowers it to a single message.
+func prefetch(c *context.Ctx, state string) int {
+	if state == ingest.StateThrottled {
+		return 1
 	}
-	if err := gz.Close(); err != nil {
-		c.Warning.Println("Failed to compress results (close):", err.Error(), "SHA256:", m.SHA256)
-		msg.Nack(false, true)
-		return
+
+	return c.Config.PrefetchCount
+}
+
+// applyPressure adjusts the consumer to a new backpressure state. It
+// cancels the consumer, which closes its delivery channel, if it has to
+// pause or the prefetch count changes, and reports whether it did.
+func applyPressure(c *context.Ctx, channel *amqp.Channel, consumer string, state, next string) (bool, error) {
+	switch next {
+	case ingest.StatePaused:
+		c.Warning.Println("Storage is failing, pausing AMQP consumer")
+	case ingest.StateThrottled:
+		c.Warning.Println("Storage is slow, throttling AMQP consumer")
+	case ingest.StateBuffering:
+		c.Warning.Println("Storage is failing, buffering results on disk")
+	default:
+		c.Info.Println("Storage recovered, AMQP consumer running at full speed")
 	}
 
-	result := &dataStorage.Result{
-		Id:                "",                        //will be filled by the storage engine
-		SHA256:            strings.ToLower(m.SHA256), //totem currently send the hash all upper case
-		SchemaVersion:     "1",
-		UserId:            "NotSend",
-		SourceId:          []string{"NotSend"},
-		SourceTag:         []string{"NotSend"},
-		ServiceName:       strings.SplitN(msg.RoutingKey, ".", 2)[0],
-		ServiceVersion:    "NotSend",
-		ServiceConfig:     "NotSend",
-		ObjectCategory:    []string{"NotSend"},
-		ObjectType:        "sample",
-		Results:           resultsGZ.Bytes(),
-		Tags:              m.Tags,
-		ExecutionTime:     time.Now(),
-		WatchguardStatus:  "NotImplemented",
-		WatchguardLog:     []string{"NotImplemented"},
-		WatchguardVersion: "NotImplemented",
-		Comment:           "",
+	if next != ingest.StatePaused && prefetch(c, state) == prefetch(c, next) {
+		return false, nil
 	}
 
-	err = c.Data.ResultStore(result)
+	return true, channel.Cancel(consumer, false)
+}
+
+func handleMessage(c *context.Ctx, msg amqp.Delivery) {
+	c.Debug.Println("Msg:", string(msg.Body))
+
+	_, err := ingest.Accept(c, msg.Body, strings.SplitN(msg.RoutingKey, ".", 2)[0])
 	if err != nil {
-		c.Warning.Println("Failed to safe result:", err.Error(), "SHA256:", m.SHA256)
-		msg.Nack(false, true)
+		c.Warning.Println(err.Error())
+
+		// invalid messages are dropped, everything else is retried
+		msg.Nack(false, !ingest.IsInvalid(err))
 		return
 	}
 
@@ -0,0 +1,186 @@
+package amqp
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/HolmesProcessing/Holmes-Storage/context"
+
+	"github.com/streadway/amqp"
+)
+
+// rpcRequest is a lookup sent to the RPC queue. The reply is published
+// to the reply_to queue of the request, using its correlation_id.
+type rpcRequest struct {
+	// Action is one of object, submission, result or sample.
+	Action string `json:"action"`
+
+	// Id is the sha256 for objects and samples and the uuid for
+	// submissions and results.
+	Id string `json:"id"`
+}
+
+// rpcResponse mirrors the response of the HTTP API.
+type rpcResponse struct {
+	ResponseCode int
+	Failure      string      `json:",omitempty"`
+	Result       interface{} `json:",omitempty"`
+}
+
+// RPCServer answers lookups received on the configured RPC queue.
+type RPCServer struct {
+	lock  sync.Mutex
+	state string
+}
+
+func (s *RPCServer) setState(state string) {
+	s.lock.Lock()
+	s.state = state
+	s.lock.Unlock()
+}
+
+// Ping fails unless the server is subscribed to the RPC queue.
+func (s *RPCServer) Ping() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch s.state {
+	case consumerConsuming:
+		return nil
+	case "":
+		return errors.New("AMQP RPC server isn't started")
+	}
+
+	return errors.New("AMQP RPC server is " + s.state)
+}
+
+// Serve answers lookups until the channel breaks down. It only returns on
+// errors.
+func (s *RPCServer) Serve(c *context.Ctx) error {
+	s.setState(consumerConnecting)
+	defer s.setState(consumerStopped)
+
+	amqpConn, err := amqp.Dial(c.Config.AMQP)
+	if err != nil {
+		return errors.New("Contacting the AMQP server failed with " + err.Error())
+	}
+	defer amqpConn.Close()
+
+	channel, err := amqpConn.Channel()
+	if err != nil {
+		return errors.New("Initializing AMQP channel failed with " + err.Error())
+	}
+
+	_, err = channel.QueueDeclare(
+		c.Config.RPCQueue, // name
+		true,              // durable
+		false,             // delete when unused
+		false,             // exclusive
+		false,             // no-wait
+		nil,               // arguments
+	)
+	if err != nil {
+		return errors.New("Declaring RPC queue failed with " + err.Error())
+	}
+
+	err = channel.Qos(
+		c.Config.PrefetchCount, // prefetch count
+		0,                      // prefetch size
+		false,                  // global
+	)
+	if err != nil {
+		return errors.New("Setting QoS failed with " + err.Error())
+	}
+
+	msgs, err := channel.Consume(
+		c.Config.RPCQueue, // queue
+		"",                // consumer
+		false,             // auto-ack
+		false,             // exclusive
+		false,             // no-local
+		false,             // no-wait
+		nil,               // args
+	)
+	if err != nil {
+		return errors.New("Channel consume failed with " + err.Error())
+	}
+	s.setState(consumerConsuming)
+
+	for m := range msgs {
+		c.Debug.Println("Received RPC request:", string(m.Body))
+		handleRequest(c, channel, m)
+	}
+
+	return errors.New("AMQP RPC channel was closed")
+}
+
+func handleRequest(c *context.Ctx, channel *amqp.Channel, msg amqp.Delivery) {
+	if msg.ReplyTo == "" {
+		c.Warning.Println("Dropping RPC request without reply_to")
+		msg.Nack(false, false)
+		return
+	}
+
+	resp := &rpcResponse{}
+	result, err := lookup(c, msg.Body)
+	if err != nil {
+		resp.ResponseCode = 1
+		resp.Failure = err.Error()
+	} else {
+		resp.Result = result
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		c.Warning.Println("Failed to encode RPC response:", err.Error())
+		msg.Nack(false, false)
+		return
+	}
+
+	err = channel.Publish(
+		"",          // exchange
+		msg.ReplyTo, // routing key
+		false,       // mandatory
+		false,       // immediate
+		amqp.Publishing{
+			ContentType:   "application/json",
+			CorrelationId: msg.CorrelationId,
+			Body:          body,
+		},
+	)
+	if err != nil {
+		c.Warning.Println("Failed to publish RPC response:", err.Error())
+		msg.Nack(false, true)
+		return
+	}
+
+	msg.Ack(false)
+}
+
+// lookup decodes a request and fetches the requested entry.
+func lookup(c *context.Ctx, body []byte) (interface{}, error) {
+	req := &rpcRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, errors.New("Could not decode request: " + err.Error())
+	}
+
+	id := strings.ToLower(req.Id)
+	if id == "" {
+		return nil, errors.New("Please supply an id!")
+	}
+
+	switch req.Action {
+	case "object":
+		return c.Data.ObjectGet(id)
+	case "submission":
+		return c.Data.SubmissionGet(id)
+	case "result":
+		return c.Data.ResultGet(id)
+	case "sample":
+		return c.Objects.SampleGet(id)
+	default:
+		return nil, errors.New("Unknown action: " + req.Action)
+	}
+}
@@ -0,0 +1,425 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Storage/context"
+	"github.com/HolmesProcessing/Holmes-Storage/dataStorage"
+)
+
+// DefaultLimit is the maximum number of objects a filter selects if no
+// limit is given.
+const DefaultLimit = 10000
+
+// Export writes many samples into one archive, each as samples/<sha256>,
+// followed by manifest.json describing their objects and submissions.
+// The archive is written while the samples are fetched, so it can be
+// streamed to a client. Samples which can't be exported are listed in the
+// manifest along with the error.
+type Export struct {
+	// Format is "tar" (default), "tar.gz" or "zip". Zip archives are
+	// protected by Password.
+	Format   string
+	Password string
+
+	Exported int
+	Failed   int
+}
+
+// Manifest lists the exported samples.
+type Manifest struct {
+	Created time.Time        `json:"created"`
+	Samples []*ManifestEntry `json:"samples"`
+}
+
+type ManifestEntry struct {
+	SHA256      string                    `json:"sha256"`
+	File        string                    `json:"file,omitempty"`
+	Object      *dataStorage.Object       `json:"object,omitempty"`
+	Submissions []*dataStorage.Submission `json:"submissions,omitempty"`
+	Error       string                    `json:"error,omitempty"`
+}
+
+// fileWriter is implemented by all archive formats.
+type fileWriter interface {
+	Add(name string, modified time.Time, data []byte) error
+	Close() error
+}
+
+// Extension returns the file extension of the archive, or an error if the
+// format is unknown.
+func (e *Export) Extension() (string, error) {
+	switch e.Format {
+	case "", "tar":
+		return ".tar", nil
+	case "tar.gz":
+		return ".tar.gz", nil
+	case "zip":
+		return ".zip", nil
+	}
+
+	return "", errors.New("Unknown export format: " + e.Format)
+}
+
+// ContentType returns the mime type of the archive.
+func (e *Export) ContentType() string {
+	switch e.Format {
+	case "tar.gz":
+		return "application/gzip"
+	case "zip":
+		return "application/zip"
+	}
+
+	return "application/x-tar"
+}
+
+// Run writes the samples to w. It only fails if the archive itself can't
+// be written.
+func (e *Export) Run(c *context.Ctx, w io.Writer, ids []string) error {
+	if _, err := e.Extension(); err != nil {
+		return err
+	}
+
+	var fw fileWriter
+	switch e.Format {
+	case "zip":
+		fw = NewZipWriter(w, e.Password)
+	case "tar.gz":
+		fw = newTarWriter(w, true)
+	default:
+		fw = newTarWriter(w, false)
+	}
+
+	manifest := &Manifest{
+		Created: time.Now(),
+		Samples: make([]*ManifestEntry, 0, len(ids)),
+	}
+
+	for _, id := range ids {
+		entry := &ManifestEntry{SHA256: id}
+		manifest.Samples = append(manifest.Samples, entry)
+
+		data, err := e.collect(c, entry)
+		if err != nil {
+			entry.Error = err.Error()
+			e.Failed++
+			continue
+		}
+
+		entry.File = "samples/" + id
+		if err = fw.Add(entry.File, entry.Object.CreationDateTime, data); err != nil {
+			return err
+		}
+		e.Exported++
+	}
+
+	j, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = fw.Add("manifest.json", manifest.Created, j); err != nil {
+		return err
+	}
+
+	return fw.Close()
+}
+
+// collect fills the manifest entry and returns the sample.
+func (e *Export) collect(c *context.Ctx, entry *ManifestEntry) ([]byte, error) {
+	if !isSHA256(entry.SHA256) {
+		return nil, errors.New("Invalid sha256")
+	}
+
+	object, err := c.Data.ObjectGet(entry.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	entry.Object = object
+
+	if entry.Submissions, err = c.Data.SubmissionsGetByObject(entry.SHA256); err != nil {
+		return nil, errors.New("Getting the submissions failed: " + err.Error())
+	}
+
+	sample, err := c.Objects.SampleGet(entry.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	return sample.Data, nil
+}
+
+// SelectFilters are the parameters Select takes from the filter.
+var SelectFilters = []string{"mime", "md5", "sha512", "imphash", "section_hash", "elf_import_hash", "source", "user_id", "limit"}
+
+// Select returns the sha256s listed in ids (comma or whitespace separated)
+// followed by the ones of the objects matching the filter. Objects can be
+// filtered by "mime", "md5", "sha512", "imphash", "section_hash" and
+// "elf_import_hash" and by the "source" and "user_id" of their
+// submissions, all given filters have to match. "limit" caps the number of
+// objects the filter selects.
+//
+// Only the most selective filter is looked up, the candidates it yields
+// are checked against the other filters. If too few of them match, more
+// candidates are looked up, up to maxCandidates.
+func Select(c *context.Ctx, ids []string, filter url.Values) ([]string, error) {
+	var selected []string
+	seen := make(map[string]bool)
+	add := func(id string) {
+		id = strings.ToLower(id)
+		if !seen[id] {
+			seen[id] = true
+			selected = append(selected, id)
+		}
+	}
+
+	for _, list := range ids {
+		for _, id := range strings.Fields(strings.Replace(list, ",", " ", -1)) {
+			add(id)
+		}
+	}
+
+	limit := DefaultLimit
+	if filter.Get("limit") != "" {
+		var err error
+		if limit, err = strconv.Atoi(filter.Get("limit")); err != nil || limit <= 0 {
+			return nil, errors.New("Invalid limit: " + filter.Get("limit"))
+		}
+	}
+
+	f := newObjectFilter(filter)
+	if f.empty() {
+		if len(selected) == 0 {
+			return nil, errors.New("Please supply sha256s or a filter")
+		}
+		return selected, nil
+	}
+
+	matched := 0
+	checked := make(map[string]bool)
+	for n := limit; ; n *= 4 {
+		if n > maxCandidates {
+			n = maxCandidates
+		}
+
+		candidates, err := f.candidates(c, n)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range candidates {
+			if matched == limit {
+				return selected, nil
+			}
+			if checked[id] {
+				continue
+			}
+			checked[id] = true
+
+			ok, err := f.match(c, id)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matched++
+				add(id)
+			}
+		}
+
+		// all candidates were looked up
+		if len(candidates) < n || n == maxCandidates {
+			return selected, nil
+		}
+	}
+}
+
+// maxCandidates caps the objects looked up by the most selective filter
+// of Select.
+const maxCandidates = 100 * DefaultLimit
+
+// objectFilter holds the filters of Select.
+type objectFilter struct {
+	mime, md5, sha512, imphash, sectionHash, elfImportHash string
+	source, userId                                         string
+
+	// the other filters only need to be checked if more than one is given
+	filters int
+}
+
+func newObjectFilter(filter url.Values) *objectFilter {
+	f := &objectFilter{
+		mime:          filter.Get("mime"),
+		md5:           strings.ToLower(filter.Get("md5")),
+		sha512:        strings.ToLower(filter.Get("sha512")),
+		imphash:       strings.ToLower(filter.Get("imphash")),
+		sectionHash:   strings.ToLower(filter.Get("section_hash")),
+		elfImportHash: strings.ToLower(filter.Get("elf_import_hash")),
+		source:        filter.Get("source"),
+		userId:        filter.Get("user_id"),
+	}
+
+	for _, v := range []string{f.mime, f.md5, f.sha512, f.imphash, f.sectionHash, f.elfImportHash, f.source, f.userId} {
+		if v != "" {
+			f.filters++
+		}
+	}
+
+	return f
+}
+
+func (f *objectFilter) empty() bool {
+	return f.filters == 0
+}
+
+// candidates looks up to n objects by the most selective filter: a hash,
+// then the user or source of a submission and the mime type last.
+func (f *objectFilter) candidates(c *context.Ctx, n int) ([]string, error) {
+	var search *dataStorage.Object
+	switch {
+	case f.sha512 != "":
+		search = &dataStorage.Object{SHA512: f.sha512}
+	case f.md5 != "":
+		search = &dataStorage.Object{MD5: f.md5}
+	case f.imphash != "":
+		search = &dataStorage.Object{FileImphash: f.imphash}
+	case f.elfImportHash != "":
+		search = &dataStorage.Object{FileELFImportHash: f.elfImportHash}
+	case f.sectionHash != "":
+		search = &dataStorage.Object{FileSectionHashes: []string{f.sectionHash}}
+	}
+
+	ids := []string{}
+	if search == nil && (f.userId != "" || f.source != "") {
+		submissions, err := c.Data.SubmissionSearch(&dataStorage.Submission{
+			UserId: f.userId,
+			Source: f.source,
+		}, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, submission := range submissions {
+			ids = append(ids, submission.SHA256)
+		}
+		return ids, nil
+	}
+
+	if search == nil {
+		search = &dataStorage.Object{}
+	}
+	search.FileMime = f.mime
+
+	objects, err := c.Data.ObjectSearch(search, n)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		ids = append(ids, object.SHA256)
+	}
+
+	return ids, nil
+}
+
+// match checks a candidate against all filters.
+func (f *objectFilter) match(c *context.Ctx, id string) (bool, error) {
+	if f.filters == 1 {
+		return true, nil
+	}
+
+	object, err := c.Data.ObjectGet(id)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case f.mime != "" && object.FileMime != f.mime,
+		f.md5 != "" && object.MD5 != f.md5,
+		f.sha512 != "" && object.SHA512 != f.sha512,
+		f.imphash != "" && object.FileImphash != f.imphash,
+		f.elfImportHash != "" && object.FileELFImportHash != f.elfImportHash:
+		return false, nil
+	}
+
+	if f.sectionHash != "" {
+		found := false
+		for _, section := range object.FileSectionHashes {
+			if section[strings.LastIndex(section, ":")+1:] == f.sectionHash {
+				found = true
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+
+	if f.source == "" && f.userId == "" {
+		return true, nil
+	}
+
+	submissions, err := c.Data.SubmissionsGetByObject(id)
+	if err != nil {
+		return false, err
+	}
+	for _, submission := range submissions {
+		if (f.source == "" || submission.Source == f.source) && (f.userId == "" || submission.UserId == f.userId) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func isSHA256(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 32
+}
+
+// tarWriter writes a tar archive, gzipped if requested.
+type tarWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func newTarWriter(w io.Writer, compress bool) *tarWriter {
+	t := &tarWriter{}
+	if compress {
+		t.gz = gzip.NewWriter(w)
+		w = t.gz
+	}
+	t.tw = tar.NewWriter(w)
+
+	return t
+}
+
+func (t *tarWriter) Add(name string, modified time.Time, data []byte) error {
+	err := t.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: modified,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = t.tw.Write(data)
+	return err
+}
+
+func (t *tarWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if t.gz != nil {
+		return t.gz.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,321 @@
+package archive
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultPassword is the password malware archives are usually protected
+// with, so analysts and their tools know it.
+const DefaultPassword = "infected"
+
+// ZipWriter writes a zip archive whose files are encrypted with the
+// traditional PKWARE encryption (ZipCrypto). It is weak, but its purpose
+// is keeping samples away from virus scanners and accidental execution,
+// not secrecy, and every unzip tool can open it. The standard library
+// can't write encrypted archives.
+//
+// Files, offsets and archives beyond 4 GB or 65535 files are written with
+// the zip64 extensions, only where needed, so small archives stay
+// readable by old tools.
+type ZipWriter struct {
+	w        io.Writer
+	password []byte
+	offset   int64
+	entries  []*zipEntry
+}
+
+type zipEntry struct {
+	name             string
+	flags            uint16
+	modTime, modDate uint16
+	crc              uint32
+	compressedSize   uint64
+	size             uint64
+	offset           uint64
+}
+
+const (
+	zipVersion       = 20 // 2.0: deflate and traditional encryption
+	zipVersion64     = 45 // 4.5: zip64 extensions
+	zipFlagEncrypt   = 0x1
+	zipFlagUTF8      = 0x800
+	zipMethodDeflate = 8
+	zipExtraZip64    = 0x0001
+
+	// sizes and offsets from zipMax32 and counts from zipMax16 on are
+	// stored in the zip64 records
+	zipMax32 = 0xffffffff
+	zipMax16 = 0xffff
+)
+
+// NewZipWriter returns a ZipWriter writing to w, DefaultPassword is used
+// if the password is empty.
+func NewZipWriter(w io.Writer, password string) *ZipWriter {
+	if password == "" {
+		password = DefaultPassword
+	}
+
+	return &ZipWriter{
+		w:        w,
+		password: []byte(password),
+	}
+}
+
+// Add compresses, encrypts and writes a file to the archive.
+func (z *ZipWriter) Add(name string, modified time.Time, data []byte) error {
+	if len(name) > zipMax16 {
+		return errors.New("File name " + name[:64] + "... is too long for a zip archive")
+	}
+
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if _, err = fw.Write(data); err != nil {
+		return err
+	}
+	if err = fw.Close(); err != nil {
+		return err
+	}
+
+	e := &zipEntry{
+		name:   name,
+		flags:  zipFlagEncrypt,
+		crc:    crc32.ChecksumIEEE(data),
+		size:   uint64(len(data)),
+		offset: uint64(z.offset),
+	}
+	e.modTime, e.modDate = dosTime(modified)
+	if !isASCII(name) && utf8.ValidString(name) {
+		e.flags |= zipFlagUTF8
+	}
+
+	// the encryption header is 11 random bytes and the high byte of the
+	// crc, which unzip uses to check the password
+	header := make([]byte, 12)
+	if _, err = io.ReadFull(rand.Reader, header[:11]); err != nil {
+		return err
+	}
+	header[11] = byte(e.crc >> 24)
+
+	c := newZipCrypto(z.password)
+	encrypted := append(c.encrypt(header), c.encrypt(compressed.Bytes())...)
+	e.compressedSize = uint64(len(encrypted))
+
+	// the local header of a large file has both sizes in the zip64 field
+	version, compressedSize, size := uint16(zipVersion), uint32(e.compressedSize), uint32(e.size)
+	extra := &bytes.Buffer{}
+	if e.compressedSize >= zipMax32 || e.size >= zipMax32 {
+		version, compressedSize, size = zipVersion64, zipMax32, zipMax32
+		writeLE(extra, uint16(zipExtraZip64), uint16(16), e.size, e.compressedSize)
+	}
+
+	buf := &bytes.Buffer{}
+	writeLE(buf,
+		uint32(0x04034b50),
+		version,
+		e.flags,
+		uint16(zipMethodDeflate),
+		e.modTime,
+		e.modDate,
+		e.crc,
+		compressedSize,
+		size,
+		uint16(len(e.name)),
+		uint16(extra.Len()),
+	)
+	buf.WriteString(e.name)
+	buf.Write(extra.Bytes())
+
+	if err = z.write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err = z.write(encrypted); err != nil {
+		return err
+	}
+
+	z.entries = append(z.entries, e)
+	return nil
+}
+
+// Close writes the central directory. It doesn't close the underlying
+// writer.
+func (z *ZipWriter) Close() error {
+	start := uint64(z.offset)
+	buf := &bytes.Buffer{}
+	for _, e := range z.entries {
+		// values which don't fit are replaced by zipMax32 and moved to the
+		// zip64 field, in this order
+		version := uint16(zipVersion)
+		compressedSize, size, offset := uint32(e.compressedSize), uint32(e.size), uint32(e.offset)
+		extra := &bytes.Buffer{}
+		if e.size >= zipMax32 {
+			size = zipMax32
+			writeLE(extra, e.size)
+		}
+		if e.compressedSize >= zipMax32 {
+			compressedSize = zipMax32
+			writeLE(extra, e.compressedSize)
+		}
+		if e.offset >= zipMax32 {
+			offset = zipMax32
+			writeLE(extra, e.offset)
+		}
+		if extra.Len() > 0 {
+			version = zipVersion64
+			fields := extra.Bytes()
+			extra = &bytes.Buffer{}
+			writeLE(extra, uint16(zipExtraZip64), uint16(len(fields)))
+			extra.Write(fields)
+		}
+
+		writeLE(buf,
+			uint32(0x02014b50),
+			version,
+			version,
+			e.flags,
+			uint16(zipMethodDeflate),
+			e.modTime,
+			e.modDate,
+			e.crc,
+			compressedSize,
+			size,
+			uint16(len(e.name)),
+			uint16(extra.Len()),
+			uint16(0), // comment length
+			uint16(0), // disk number
+			uint16(0), // internal attributes
+			uint32(0), // external attributes
+			offset,
+		)
+		buf.WriteString(e.name)
+		buf.Write(extra.Bytes())
+	}
+
+	size := uint64(buf.Len())
+	records := uint64(len(z.entries))
+	if records >= zipMax16 || size >= zipMax32 || start >= zipMax32 {
+		end := start + size
+		writeLE(buf,
+			uint32(0x06064b50),
+			uint64(44), // size of the rest of the record
+			uint16(zipVersion64),
+			uint16(zipVersion64),
+			uint32(0), // number of this disk
+			uint32(0), // disk with the central directory
+			records,
+			records,
+			size,
+			start,
+		)
+
+		// the locator points to the zip64 end of central directory
+		writeLE(buf,
+			uint32(0x07064b50),
+			uint32(0), // disk with the zip64 end of central directory
+			end,
+			uint32(1), // total number of disks
+		)
+
+		if records > zipMax16 {
+			records = zipMax16
+		}
+		if size > zipMax32 {
+			size = zipMax32
+		}
+		if start > zipMax32 {
+			start = zipMax32
+		}
+	}
+
+	writeLE(buf,
+		uint32(0x06054b50),
+		uint16(0), // number of this disk
+		uint16(0), // disk with the central directory
+		uint16(records),
+		uint16(records),
+		uint32(size),
+		uint32(start),
+		uint16(0), // comment length
+	)
+
+	return z.write(buf.Bytes())
+}
+
+// writeLE writes the little endian encoding of fixed size values.
+func writeLE(buf *bytes.Buffer, values ...interface{}) {
+	for _, v := range values {
+		binary.Write(buf, binary.LittleEndian, v)
+	}
+}
+
+func (z *ZipWriter) write(p []byte) error {
+	n, err := z.w.Write(p)
+	z.offset += int64(n)
+	return err
+}
+
+// zipCrypto implements the traditional PKWARE stream cipher, see
+// APPNOTE.TXT section 6.1.
+type zipCrypto struct {
+	keys [3]uint32
+}
+
+func newZipCrypto(password []byte) *zipCrypto {
+	c := &zipCrypto{keys: [3]uint32{0x12345678, 0x23456789, 0x34567890}}
+	for _, b := range password {
+		c.update(b)
+	}
+
+	return c
+}
+
+func (c *zipCrypto) update(b byte) {
+	c.keys[0] = crc32Update(c.keys[0], b)
+	c.keys[1] = (c.keys[1]+c.keys[0]&0xff)*134775813 + 1
+	c.keys[2] = crc32Update(c.keys[2], byte(c.keys[1]>>24))
+}
+
+func (c *zipCrypto) encrypt(plaintext []byte) []byte {
+	ciphertext := make([]byte, len(plaintext))
+	for i, b := range plaintext {
+		t := c.keys[2]&0xffff | 2
+		ciphertext[i] = b ^ byte((t*(t^1))>>8)
+		c.update(b)
+	}
+
+	return ciphertext
+}
+
+func crc32Update(crc uint32, b byte) uint32 {
+	return crc32.IEEETable[byte(crc)^b] ^ crc>>8
+}
+
+// dosTime converts to the MS-DOS time and date used by zip.
+func dosTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	return uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()>>1),
+		uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,278 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// prefixedReader pretends data is preceded by prefix zero bytes, so
+// archives with offsets beyond 4 GB can be read without writing them.
+type prefixedReader struct {
+	prefix int64
+	data   []byte
+}
+
+func (r *prefixedReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off+int64(n) < r.prefix {
+		p[n] = 0
+		n++
+	}
+
+	pos := off + int64(n) - r.prefix
+	if pos >= int64(len(r.data)) {
+		if n == len(p) {
+			return n, nil
+		}
+		return n, io.EOF
+	}
+	n += copy(p[n:], r.data[pos:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *prefixedReader) size() int64 {
+	return r.prefix + int64(len(r.data))
+}
+
+func (c *zipCrypto) decrypt(ciphertext []byte) []byte {
+	plaintext := make([]byte, len(ciphertext))
+	for i, b := range ciphertext {
+		t := c.keys[2]&0xffff | 2
+		plaintext[i] = b ^ byte((t*(t^1))>>8)
+		c.update(plaintext[i])
+	}
+
+	return plaintext
+}
+
+// readEncrypted decrypts and inflates a file of the archive the way
+// unzip does and checks it against the crc.
+func readEncrypted(r io.ReaderAt, f *zip.File, password string) ([]byte, error) {
+	if f.Flags&zipFlagEncrypt == 0 {
+		return nil, errors.New("isn't encrypted")
+	}
+
+	offset, err := f.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, f.CompressedSize64)
+	if _, err = r.ReadAt(raw, offset); err != nil {
+		return nil, err
+	}
+	if len(raw) < 12 {
+		return nil, errors.New("lacks the encryption header")
+	}
+
+	plain := newZipCrypto([]byte(password)).decrypt(raw)
+	if plain[11] != byte(f.CRC32>>24) {
+		return nil, errors.New("wrong password")
+	}
+
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(plain[12:])))
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != f.CRC32 {
+		return nil, errors.New("crc mismatch")
+	}
+
+	return data, nil
+}
+
+func TestZipRoundTrip(t *testing.T) {
+	random := make([]byte, 100000)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"sample.exe", bytes.Repeat([]byte("MZ\x90\x00"), 1000)},
+		{"empty", []byte{}},
+		{"random.bin", random},
+		{"résumé.pdf.exe", []byte("utf-8 name")},
+	}
+	modified := time.Date(2017, 6, 24, 13, 37, 42, 0, time.UTC)
+
+	for _, password := range []string{"", "s3cret"} {
+		var buf bytes.Buffer
+		z := NewZipWriter(&buf, password)
+		for _, f := range files {
+			if err := z.Add(f.name, modified, f.data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.File) != len(files) {
+			t.Fatalf("archive holds %d files, expected %d", len(r.File), len(files))
+		}
+
+		if password == "" {
+			password = DefaultPassword
+		}
+		for i, f := range r.File {
+			expected := files[i]
+			if f.Name != expected.name {
+				t.Errorf("file %d is named %q, expected %q", i, f.Name, expected.name)
+			}
+			if f.CRC32 != crc32.ChecksumIEEE(expected.data) {
+				t.Errorf("%s: crc is %x, expected %x", f.Name, f.CRC32, crc32.ChecksumIEEE(expected.data))
+			}
+			if f.UncompressedSize64 != uint64(len(expected.data)) {
+				t.Errorf("%s: size is %d, expected %d", f.Name, f.UncompressedSize64, len(expected.data))
+			}
+			if !f.ModTime().Equal(modified) {
+				t.Errorf("%s: modified %s, expected %s", f.Name, f.ModTime(), modified)
+			}
+
+			data, err := readEncrypted(bytes.NewReader(buf.Bytes()), f, password)
+			if err != nil {
+				t.Errorf("%s: %v", f.Name, err)
+				continue
+			}
+			if !bytes.Equal(data, expected.data) {
+				t.Errorf("%s: content differs", f.Name)
+			}
+
+			if _, err = readEncrypted(bytes.NewReader(buf.Bytes()), f, "wrong"); err == nil {
+				t.Errorf("%s: opened with the wrong password", f.Name)
+			}
+		}
+	}
+}
+
+func TestZip64Count(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes 65536 files")
+	}
+
+	var buf bytes.Buffer
+	z := NewZipWriter(&buf, "")
+	count := zipMax16 + 1
+	for i := 0; i < count; i++ {
+		if err := z.Add(strconv.Itoa(i), time.Now(), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != count {
+		t.Fatalf("archive holds %d files, expected %d", len(r.File), count)
+	}
+
+	last := r.File[count-1]
+	data, err := readEncrypted(bytes.NewReader(buf.Bytes()), last, DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Name != strconv.Itoa(count-1) || string(data) != last.Name {
+		t.Errorf("last file is %q holding %q", last.Name, data)
+	}
+}
+
+func TestZip64Offset(t *testing.T) {
+	// the first file starts right below 4 GB, the second one beyond
+	prefix := int64(zipMax32 - 100)
+
+	var buf bytes.Buffer
+	z := NewZipWriter(&buf, "")
+	z.offset = prefix
+	files := []string{"below", "beyond"}
+	for _, name := range files {
+		if err := z.Add(name, time.Now(), bytes.Repeat([]byte(name), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pr := &prefixedReader{prefix: prefix, data: buf.Bytes()}
+	r, err := zip.NewReader(pr, pr.size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != len(files) {
+		t.Fatalf("archive holds %d files, expected %d", len(r.File), len(files))
+	}
+
+	for i, f := range r.File {
+		data, err := readEncrypted(pr, f, DefaultPassword)
+		if err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+			continue
+		}
+		if !bytes.Equal(data, bytes.Repeat([]byte(files[i]), 100)) {
+			t.Errorf("%s: content differs", f.Name)
+		}
+	}
+}
+
+func TestZip64Size(t *testing.T) {
+	// files beyond 4 GB can't be written in a test, so only the central
+	// directory is checked
+	var buf bytes.Buffer
+	z := NewZipWriter(&buf, "")
+	large := &zipEntry{
+		name:           "large",
+		flags:          zipFlagEncrypt,
+		size:           5 << 30,
+		compressedSize: zipMax32,
+	}
+	small := &zipEntry{
+		name:           "small",
+		flags:          zipFlagEncrypt,
+		size:           zipMax32 - 1,
+		compressedSize: 1000,
+		offset:         zipMax32 + 30 + 5,
+	}
+	z.entries = []*zipEntry{large, small}
+	z.offset = int64(small.offset) + 30 + 5 + int64(small.compressedSize)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pr := &prefixedReader{prefix: z.offset - int64(buf.Len()), data: buf.Bytes()}
+	r, err := zip.NewReader(pr, pr.size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 2 {
+		t.Fatalf("archive holds %d files, expected 2", len(r.File))
+	}
+
+	for i, e := range z.entries {
+		f := r.File[i]
+		if f.Name != e.name || f.UncompressedSize64 != e.size || f.CompressedSize64 != e.compressedSize {
+			t.Errorf("read %s of %d (%d compressed) bytes, expected %s of %d (%d)", f.Name, f.UncompressedSize64, f.CompressedSize64, e.name, e.size, e.compressedSize)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"time"
 
 	data "github.com/HolmesProcessing/Holmes-Storage/dataStorage"
 	objects "github.com/HolmesProcessing/Holmes-Storage/objectStorage"
@@ -14,22 +15,80 @@ import (
 type config struct {
 	DataStorage   []*data.Connector
 	ObjectStorage []*objects.Connector
-	LogFile       string
-	LogLevel      string
+
+	// Samples are replicated to every ObjectStorage connector if set.
+	// Writes succeed once ObjectStorageWriteQuorum (default: all)
+	// replicas stored the sample.
+	ObjectStorageReplication bool
+	ObjectStorageWriteQuorum int
+
+	// Samples which weren't read for TieringMaxIdle days are moved from
+	// the ObjectStorage to the ColdObjectStorage every TieringInterval
+	// hours (0: only when called with -tier), if it is set.
+	ColdObjectStorage []*objects.Connector
+	TieringMaxIdle    int // days
+	TieringInterval   int // hours
+
+	LogFile  string
+	LogLevel string
+
+	// Samples are encrypted if master keys are configured, either
+	// inline (id -> base64 encoded 256 bit key) or in a JSON file with
+	// the same layout. New samples use the key EncryptionKeyId.
+	EncryptionKeys    map[string]string
+	EncryptionKeyFile string
+	EncryptionKeyId   string
+
+	// Samples are compressed with gzip or zstd before they are
+	// (encrypted and) stored, if set.
+	SampleCompression string
+
+	// Samples read are checked against their sha256: "fail" (default)
+	// rejects mismatching samples, "warn" only logs them, "off".
+	SampleVerification string
+
+	// Ingest lists the sources results are received from: "amqp"
+	// (default) and/or "spool". Results can always be pushed over HTTP.
+	Ingest        []string
+	SpoolDir      string
+	SpoolInterval int // seconds
+
+	// Ingestion is throttled if storing results takes longer than
+	// BackpressureLatency on average and paused if more than
+	// BackpressureErrorRate of them fail. The storage is probed every
+	// BackpressureProbe seconds while paused.
+	BackpressureLatency   int // milliseconds
+	BackpressureErrorRate float64
+	BackpressureProbe     int // seconds
+
+	// Results are buffered in WALDir instead of being rejected while
+	// the storage is failing, if it is set.
+	WALDir           string
+	WALMaxSize       int64 // megabytes, 0 = unlimited
+	WALFlushInterval int   // seconds
 
 	AMQP          string
 	Queue         string
 	RoutingKey    string
 	PrefetchCount int
+	RPCQueue      string // lookups are only answered over AMQP if set
 
 	HTTP    string
 	SSLCert string
 	SSLKey  string
+
+	// Password of the zip archives samples are downloaded in,
+	// "infected" if empty.
+	ArchivePassword string
 }
 
 type Ctx struct {
 	Config *config
 
+	// Maintenance runs like rewrapping read every sample, which mustn't
+	// count as access for the tiering. It has to be set before Initialize.
+	Maintenance bool
+
 	Data    data.Storage
 	Objects objects.Storage
 
@@ -60,6 +119,9 @@ func (c *Ctx) Initialize(path string) {
 	}
 
 	c.SetObjects()
+	c.SetEncryption()
+	c.SetCompression()
+	c.SetVerification()
 	err = c.Objects.Initialize(c.Config.ObjectStorage)
 	if err != nil {
 		panic("Object storage initialization failed! " + err.Error())
@@ -82,16 +144,122 @@ func (c *Ctx) SetData() {
 }
 
 func (c *Ctx) SetObjects() {
-	switch c.Config.ObjectStorage[0].Engine {
+	c.setPrimaryObjects()
+
+	if len(c.Config.ColdObjectStorage) == 0 {
+		return
+	}
+
+	tiered := &objects.Tiered{
+		Hot:            c.Objects,
+		Cold:           objectEngine(c.Config.ColdObjectStorage[0].Engine),
+		ColdConnectors: c.Config.ColdObjectStorage,
+		MaxIdle:        time.Duration(c.Config.TieringMaxIdle) * 24 * time.Hour,
+	}
+	if !c.Maintenance {
+		tiered.Access = c.Data
+	}
+	c.Objects = tiered
+
+	c.Debug.Println("Loaded", c.Config.ColdObjectStorage[0].Engine, "as cold object storage")
+}
+
+func (c *Ctx) setPrimaryObjects() {
+	if !c.Config.ObjectStorageReplication {
+		c.Objects = objectEngine(c.Config.ObjectStorage[0].Engine)
+		c.Debug.Println("Loaded", c.Config.ObjectStorage[0].Engine, "as object storage")
+		return
+	}
+
+	// every connector is a backend of its own
+	replicated := &objects.Replicated{
+		Backends:    make([]objects.Storage, len(c.Config.ObjectStorage)),
+		WriteQuorum: c.Config.ObjectStorageWriteQuorum,
+	}
+	for i, connector := range c.Config.ObjectStorage {
+		replicated.Backends[i] = objectEngine(connector.Engine)
+		c.Debug.Println("Loaded", connector.Engine, "as object storage replica", i)
+	}
+	c.Objects = replicated
+}
+
+func objectEngine(engine string) objects.Storage {
+	switch engine {
 	case "S3":
-		c.Objects = &objects.S3{}
-	//case "local-fs":
-	//	c.Objects = &objects.LocalFS{}
+		return &objects.S3{}
+	case "local-fs":
+		return &objects.LocalFS{}
 	default:
 		panic("Please supply a valid object storage engine!")
 	}
+}
+
+// SetEncryption wraps the object storage so samples are encrypted, if
+// master keys are configured.
+func (c *Ctx) SetEncryption() {
+	keys := make(map[string]string)
+	for id, key := range c.Config.EncryptionKeys {
+		keys[id] = key
+	}
+
+	if c.Config.EncryptionKeyFile != "" {
+		kfile, err := os.Open(c.Config.EncryptionKeyFile)
+		if err != nil {
+			panic("Couldn't open the encryption key file! " + err.Error())
+		}
+		err = json.NewDecoder(kfile).Decode(&keys)
+		kfile.Close()
+		if err != nil {
+			panic("Couldn't decode the encryption key file! " + err.Error())
+		}
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	encrypted := &objects.Encrypted{
+		Storage: c.Objects,
+		KeyId:   c.Config.EncryptionKeyId,
+	}
+	if err := encrypted.SetKeys(keys); err != nil {
+		panic("Loading the encryption keys failed! " + err.Error())
+	}
+	c.Objects = encrypted
+
+	c.Debug.Println("Encrypting samples with master key", c.Config.EncryptionKeyId)
+}
+
+// SetCompression wraps the object storage so samples are compressed, if
+// a codec is configured. It is always set, so samples compressed before
+// the codec was turned off can still be read. It has to wrap the
+// encryption, encrypted samples can't be compressed anymore.
+func (c *Ctx) SetCompression() {
+	c.Objects = &objects.Compressed{
+		Storage: c.Objects,
+		Codec:   c.Config.SampleCompression,
+	}
+
+	if c.Config.SampleCompression != "" {
+		c.Debug.Println("Compressing samples with", c.Config.SampleCompression)
+	}
+}
+
+// SetVerification wraps the object storage so samples are checked when
+// they are read. It is always set, so the storage can be scrubbed even
+// if the check is off.
+func (c *Ctx) SetVerification() {
+	if c.Config.SampleVerification == "" {
+		c.Config.SampleVerification = "fail"
+	}
+
+	c.Objects = &objects.Verified{
+		Storage: c.Objects,
+		Mode:    c.Config.SampleVerification,
+		Warning: c.Warning,
+	}
 
-	c.Debug.Println("Loaded", c.Config.ObjectStorage[0].Engine, "as object storage")
+	c.Debug.Println("Verifying samples on read:", c.Config.SampleVerification)
 }
 
 func (c *Ctx) SetLogging() {
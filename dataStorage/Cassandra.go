@@ -3,6 +3,7 @@ package dataStorage
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -51,241 +52,11 @@ func (s *Cassandra) Initialize(c []*Connector) error {
 	return err
 }
 
+// Setup brings a new or existing database up to date by applying all
+// pending migrations.
 func (s *Cassandra) Setup() error {
-	// test if tables already exist
-	if err := s.DB.Query("SELECT * FROM results LIMIT 1;").Exec(); err == nil {
-		return errors.New("Table results already exists, aborting!")
-	}
-	if err := s.DB.Query("SELECT * FROM objects LIMIT 1;").Exec(); err == nil {
-		return errors.New("Table objects already exists, aborting!")
-	}
-	if err := s.DB.Query("SELECT * FROM submissions LIMIT 1;").Exec(); err == nil {
-		return errors.New("Table submissions already exists, aborting!")
-	}
-	if err := s.DB.Query("SELECT * FROM config LIMIT 1;").Exec(); err == nil {
-		return errors.New("Table config already exists, aborting!")
-	}
-
-	// create tables
-	// spaces needed, !NO TABS!
-	tableResults := `CREATE TABLE results(
-        id timeuuid,
-        sha256 text,
-        schema_version text,
-        user_id text,
-        source_id set<text>,
-        source_tag set<text>,
-        service_name text,
-        service_version text,
-        service_config text,
-        object_category set<text>,
-        object_type text,
-        results blob,
-        tags set<text>,
-        execution_time timestamp,
-        watchguard_status text,
-        watchguard_log list<text>,
-        watchguard_version text,
-        comment text,
-    PRIMARY KEY ((service_name, object_type), id, service_version))
-    WITH CLUSTERING ORDER BY (id DESC)
-    AND compression = { 
-        'enabled': 'true', 
-        'class' : 'LZ4Compressor' 
-    };`
-	if err := s.DB.Query(tableResults).Exec(); err != nil {
-		return err
-	}
-
-	tableResultsMetaBySHA256 := `CREATE MATERIALIZED VIEW results_meta_by_sha256 AS
-        SELECT id, sha256, schema_version, user_id, source_id, source_tag, service_name, service_version, service_config, object_category, object_type, tags, execution_time, watchguard_status, watchguard_log, watchguard_version, comment FROM results
-        WHERE sha256 IS NOT NULL 
-        AND id IS NOT NULL 
-        AND service_name IS NOT NULL 
-        AND service_version IS NOT NULL 
-        AND object_type IS NOT NULL
-        PRIMARY KEY((sha256), id, service_name, service_version, object_type)
-        WITH CLUSTERING ORDER BY (id DESC);`
-	if err := s.DB.Query(tableResultsMetaBySHA256).Exec(); err != nil {
-		return err
-	}
-
-	tableResultsDataBySHA256 := `CREATE MATERIALIZED VIEW results_data_by_sha256 AS
-        SELECT id, sha256, service_name, service_version, object_type, results FROM results
-        WHERE sha256 IS NOT NULL 
-        AND id IS NOT NULL 
-        AND service_name IS NOT NULL 
-        AND service_version IS NOT NULL 
-        AND object_type IS NOT NULL
-        PRIMARY KEY((sha256), id, service_name, service_version, object_type)
-        WITH CLUSTERING ORDER BY (id DESC);`
-	if err := s.DB.Query(tableResultsDataBySHA256).Exec(); err != nil {
-		return err
-	}
-
-	tableObjects := `CREATE TABLE objects(
-        type text,
-        creation_date_time timestamp,
-        submissions set<timeuuid>,
-        source set<text>,
-
-        md5 text,
-        sha1 text,
-        sha256 text,
-
-        file_mime text,
-        file_name set<text>,
-
-        domain_fqdn text,
-        domain_tld text,
-        domain_sub_domain text,
-
-        ip_address inet,
-        ip_v6 boolean,
-
-        email_address text,
-        email_local_part text,
-        email_domain_part text,
-        email_sub_addressing text,
-
-        generic_identifier text,
-        generic_type text,
-        generic_data_rel_address text,
-    PRIMARY KEY ((sha256), creation_date_time, type))
-    WITH CLUSTERING ORDER BY (creation_date_time DESC)
-    AND compression = { 
-        'enabled': 'true', 
-        'class' : 'LZ4Compressor' 
-    };`
-	if err := s.DB.Query(tableObjects).Exec(); err != nil {
-		return err
-	}
-
-	tableObjectsByTypeFile := `CREATE MATERIALIZED VIEW objects_by_type_file AS
-        SELECT creation_date_time, submissions, source, md5, sha1, sha256, file_mime, file_name
-        FROM objects
-        WHERE file_mime IS NOT NULL
-        AND creation_date_time IS NOT NULL
-        AND sha256 IS NOT NULL
-        AND type = 'file'
-        PRIMARY KEY((file_mime), creation_date_time, sha256, type)
-        WITH CLUSTERING ORDER BY (creation_date_time DESC);`
-	if err := s.DB.Query(tableObjectsByTypeFile).Exec(); err != nil {
-		return err
-	}
-
-	tableSubmissions := `CREATE TABLE submissions(
-        id timeuuid,
-        sha256 text,
-        user_id text,
-        source text,
-        date_time timestamp,
-        obj_name text,
-        tags set<text>,
-        comment text,
-    PRIMARY KEY ((sha256), id))
-    WITH CLUSTERING ORDER BY (id DESC)
-    AND compression = { 
-        'enabled': 'true', 
-        'class' : 'LZ4Compressor'
-    };`
-	if err := s.DB.Query(tableSubmissions).Exec(); err != nil {
-		return err
-	}
-	tableSubmissionsByUser := `CREATE MATERIALIZED VIEW submissions_by_user_id
-        AS SELECT *
-        FROM submissions
-        WHERE user_id IS NOT NULL 
-        AND id IS NOT NULL 
-        AND sha256 IS NOT NULL
-        PRIMARY KEY((user_id), id, sha256)
-        WITH CLUSTERING ORDER BY (id desc);`
-	if err := s.DB.Query(tableSubmissionsByUser).Exec(); err != nil {
-		return err
-	}
-	tableSubmissionsBySource := `CREATE MATERIALIZED VIEW submissions_by_source
-        AS SELECT *
-        FROM submissions
-        WHERE source IS NOT NULL 
-        AND id IS NOT NULL 
-        AND sha256 IS NOT NULL
-        PRIMARY KEY((source), id, sha256)
-        WITH CLUSTERING ORDER BY (id desc);`
-	if err := s.DB.Query(tableSubmissionsBySource).Exec(); err != nil {
-		return err
-	}
-
-	tableConfig := `CREATE TABLE config(
-        path text PRIMARY KEY,
-        file_contents text
-    );`
-	if err := s.DB.Query(tableConfig).Exec(); err != nil {
-		return err
-	}
-
-	//TODO: add complex SASI indexes on tags, object_category, etc when supported by Cassandra
-	//TODO: add indexes for other entries (watchguard_status, user_id, service_version) under results when totem catches up
-
-	// Add SASI indexes for results
-	tableResultsIndex := `CREATE CUSTOM INDEX results_comment_idx 
-        ON results (comment) 
-        USING 'org.apache.cassandra.index.sasi.SASIIndex' 
-        WITH OPTIONS = {
-            'analyzed' : 'true', 
-            'analyzer_class' : 'org.apache.cassandra.index.sasi.analyzer.StandardAnalyzer', 
-            'tokenization_enable_stemming' : 'true', 
-            'tokenization_locale' : 'en', 
-            'tokenization_normalize_lowercase' : 'true', 
-            'tokenization_skip_stop_words' : 'true'
-        };`
-	if err := s.DB.Query(tableResultsIndex).Exec(); err != nil {
-		return err
-	}
-
-	//////////
-	// WARNING: Uncomment only if needed. This can increase physical storage costs by ~40% with 1 million samples and 4 Services.
-	//	tableResultsIndex := `CREATE CUSTOM INDEX results_results_idx
-	//	ON results (results)
-	//	USING 'org.apache.cassandra.index.sasi.SASIIndex'
-	//	WITH OPTIONS = {
-	//		'analyzed' : 'true',
-	//		'analyzer_class' : 'org.apache.cassandra.index.sasi.analyzer.StandardAnalyzer',
-	//		'tokenization_enable_stemming' : 'false',
-	//		'tokenization_locale' : 'en',
-	//		'tokenization_normalize_lowercase' : 'true',
-	//		'tokenization_skip_stop_words' : 'true',
-	//		'max_compaction_flush_memory_in_mb': '512'
-	//		};`
-	//	if err := s.DB.Query(tableResultsIndex).Exec(); err != nil {
-	//		return err
-	//	}
-	//////////
-
-	// Add SASI indexes for objects
-	tableObjectsIndex := `CREATE CUSTOM INDEX objects_md5_idx 
-        ON objects (md5) 
-        USING 'org.apache.cassandra.index.sasi.SASIIndex';`
-	if err := s.DB.Query(tableObjectsIndex).Exec(); err != nil {
-		return err
-	}
-
-	// Add SASI indexes for submissions
-	tableSubmissionsIndex := `CREATE CUSTOM INDEX submissions_comment_idx 
-        ON submissions (comment) 
-        USING 'org.apache.cassandra.index.sasi.SASIIndex' 
-        WITH OPTIONS = {
-            'analyzed' : 'true', 
-            'analyzer_class' : 'org.apache.cassandra.index.sasi.analyzer.StandardAnalyzer', 
-            'tokenization_enable_stemming' : 'true', 
-            'tokenization_locale' : 'en', 
-            'tokenization_normalize_lowercase' : 'true', 
-            'tokenization_skip_stop_words' : 'true'
-        };`
-	if err := s.DB.Query(tableSubmissionsIndex).Exec(); err != nil {
-		return err
-	}
-
-	return nil
+	_, err := s.Migrate(false)
+	return err
 }
 
 func (s *Cassandra) Recover() {
@@ -303,6 +74,19 @@ func (s *Cassandra) Recover() {
 	recoverLock.Unlock()
 }
 
+// Ping runs a trivial query, which fails if no node of the cluster
+// answers. It waits while a broken connection is being recovered.
+func (s *Cassandra) Ping() error {
+	recoverLock.RLock()
+	defer recoverLock.RUnlock()
+
+	if s.DB == nil || s.DB.Closed() {
+		return errors.New("Cassandra session is closed")
+	}
+
+	return s.DB.Query("SELECT release_version FROM system.local").Exec()
+}
+
 func (s *Cassandra) ObjectGet(sha256 string) (object *Object, err error) {
 	defer func() {
 		recoverLock.RUnlock()
@@ -316,7 +100,7 @@ func (s *Cassandra) ObjectGet(sha256 string) (object *Object, err error) {
 	object = &Object{}
 
 	recoverLock.RLock()
-	err = s.DB.Query("SELECT type, creation_date_time, submissions, source, md5, sha1, sha256, file_mime, file_name, domain_fqdn, domain_tld, domain_sub_domain, ip_address, ip_v6, email_address, email_local_part, email_domain_part, email_sub_addressing, generic_identifier, generic_type, generic_data_rel_address FROM objects WHERE sha256 = ? LIMIT 1", sha256).Scan(
+	err = s.DB.Query("SELECT type, creation_date_time, submissions, source, md5, sha1, sha256, sha512, file_mime, file_name, file_tlsh, file_ssdeep, file_imphash, file_section_hashes, file_elf_import_hash, domain_fqdn, domain_tld, domain_sub_domain, ip_address, ip_v6, email_address, email_local_part, email_domain_part, email_sub_addressing, generic_identifier, generic_type, generic_data_rel_address, tags FROM objects WHERE sha256 = ? LIMIT 1", sha256).Scan(
 		&object.Type,
 		&object.CreationDateTime,
 		&object.Submissions,
@@ -324,8 +108,14 @@ func (s *Cassandra) ObjectGet(sha256 string) (object *Object, err error) {
 		&object.MD5,
 		&object.SHA1,
 		&object.SHA256,
+		&object.SHA512,
 		&object.FileMime,
 		&object.FileName,
+		&object.FileTLSH,
+		&object.FileSSDeep,
+		&object.FileImphash,
+		&object.FileSectionHashes,
+		&object.FileELFImportHash,
 		&object.DomainFQDN,
 		&object.DomainTLD,
 		&object.DomainSubDomain,
@@ -338,13 +128,23 @@ func (s *Cassandra) ObjectGet(sha256 string) (object *Object, err error) {
 		&object.GenericIdentifier,
 		&object.GenericType,
 		&object.GenericDataRelAddress,
+		&object.Tags,
 	)
 
 	if err == gocql.ErrTimeoutNoResponse {
 		panic("connection broke")
 	}
 
-	return object, err
+	return object, notFound(err)
+}
+
+// notFound replaces the gocql error for missing rows by ErrNotFound.
+func notFound(err error) error {
+	if err == gocql.ErrNotFound {
+		return ErrNotFound
+	}
+
+	return err
 }
 
 func (s *Cassandra) ObjectStore(obj *Object) (bool, error) {
@@ -369,10 +169,13 @@ func (s *Cassandra) ObjectStore(obj *Object) (bool, error) {
 		return false, errors.New("Object was never submitted!")
 	}
 
-	if l > 1 {
-		// the object is known so we just update the information
-		objFromDB, err := s.ObjectGet(obj.SHA256)
+	objFromDB, err := s.ObjectGet(obj.SHA256)
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
 
+	if err == nil {
+		// the object is known so we just update the information
 		inserted = false
 
 		err = s.DB.Query(`UPDATE objects SET source = ?,  file_name = ?, submissions = ? WHERE sha256 = ? AND type = ? AND creation_date_time = ?`,
@@ -383,14 +186,45 @@ func (s *Cassandra) ObjectStore(obj *Object) (bool, error) {
 			objFromDB.Type,
 			objFromDB.CreationDateTime,
 		).Exec()
+		if err != nil {
+			return inserted, err
+		}
+
+		obj.Type = objFromDB.Type
+		obj.CreationDateTime = objFromDB.CreationDateTime
+		obj.Source = source
+		obj.FileName = file_name
+		obj.Submissions = submission_ids
+
+		// objects stored before all hashes were computed get them now
+		if obj.Type == "file" && (objFromDB.FileSSDeep == "" && obj.FileSSDeep != "" || objFromDB.SHA512 == "" && obj.SHA512 != "") {
+			err = s.DB.Query(`UPDATE objects SET sha512 = ?, file_tlsh = ?, file_ssdeep = ?, file_imphash = ?, file_section_hashes = ?, file_elf_import_hash = ? WHERE sha256 = ? AND type = ? AND creation_date_time = ?`,
+				obj.SHA512,
+				obj.FileTLSH,
+				obj.FileSSDeep,
+				obj.FileImphash,
+				obj.FileSectionHashes,
+				obj.FileELFImportHash,
+				objFromDB.SHA256,
+				objFromDB.Type,
+				objFromDB.CreationDateTime,
+			).Exec()
+			if err == nil {
+				err = s.objectHashIndex(obj)
+			}
+			if err != nil {
+				return inserted, err
+			}
+		}
 
+		obj.Tags, err = s.updateObjectTags(obj.SHA256)
 		return inserted, err
 	}
 
 	// the object is unknown, hence we insert it
 
 	if obj.Type == "file" {
-		err = s.DB.Query("INSERT INTO objects (type, creation_date_time, submissions, source, md5, sha1, sha256, file_mime, file_name) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		err = s.DB.Query("INSERT INTO objects (type, creation_date_time, submissions, source, md5, sha1, sha256, sha512, file_mime, file_name, file_tlsh, file_ssdeep, file_imphash, file_section_hashes, file_elf_import_hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 			obj.Type,
 			obj.CreationDateTime,
 			submission_ids,
@@ -398,9 +232,18 @@ func (s *Cassandra) ObjectStore(obj *Object) (bool, error) {
 			obj.MD5,
 			obj.SHA1,
 			obj.SHA256,
+			obj.SHA512,
 			obj.FileMime,
 			file_name,
+			obj.FileTLSH,
+			obj.FileSSDeep,
+			obj.FileImphash,
+			obj.FileSectionHashes,
+			obj.FileELFImportHash,
 		).Exec()
+		if err == nil {
+			err = s.objectHashIndex(obj)
+		}
 	} else if obj.Type == "domain" {
 		err = s.DB.Query("INSERT INTO objects (type, creation_date_time, submissions, source, md5, sha1, sha256, domain_fqdn, domain_tld, domain_sub_domain) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 			obj.Type,
@@ -453,25 +296,160 @@ func (s *Cassandra) ObjectStore(obj *Object) (bool, error) {
 			obj.GenericType,
 			obj.GenericDataRelAddress,
 		).Exec()
+	} else {
+		return false, errors.New("Unknown object type: " + obj.Type)
 	}
 
 	obj.Source = source
 	obj.FileName = file_name
 	obj.Submissions = submission_ids
 
+	if err != nil {
+		return inserted, err
+	}
+
+	obj.Tags, err = s.updateObjectTags(obj.SHA256)
 	return inserted, err
 }
 
+// ObjectSearch finds objects by their md5, sha512, imphash, a section hash
+// or ELF import hash or, for files, by their mime type. If a hash and the
+// mime type are given the hash is looked up and the results are filtered
+// by the mime type.
 func (s *Cassandra) ObjectSearch(searchObj *Object, limit int) ([]*Object, error) {
-	return nil, errors.New("Not implemented")
+	objects := []*Object{}
+	object := &Object{}
+
+	hashes := objectHashes(searchObj)
+	for _, algorithm := range objectHashAlgorithms {
+		if len(hashes[algorithm]) > 0 {
+			return s.objectSearchByHash(algorithm, hashes[algorithm][0], searchObj.FileMime, limit)
+		}
+	}
+
+	var iter *gocql.Iter
+	if searchObj.MD5 != "" {
+		iter = s.DB.Query("SELECT type, creation_date_time, submissions, source, md5, sha1, sha256, file_mime, file_name FROM objects WHERE md5 = ? LIMIT ?", searchObj.MD5, limit).Iter()
+	} else if searchObj.FileMime != "" {
+		iter = s.DB.Query("SELECT type, creation_date_time, submissions, source, md5, sha1, sha256, file_mime, file_name FROM objects_by_type_file WHERE file_mime = ? LIMIT ?", searchObj.FileMime, limit).Iter()
+	} else {
+		return objects, errors.New("Objects can only be searched by a hash or file_mime")
+	}
+
+	for iter.Scan(
+		&object.Type,
+		&object.CreationDateTime,
+		&object.Submissions,
+		&object.Source,
+		&object.MD5,
+		&object.SHA1,
+		&object.SHA256,
+		&object.FileMime,
+		&object.FileName,
+	) {
+		if searchObj.FileMime == "" || object.FileMime == searchObj.FileMime {
+			objects = append(objects, object)
+		}
+		object = &Object{}
+	}
+
+	err := iter.Close()
+
+	return objects, err
+}
+
+// objectHashAlgorithms are the hashes looked up in objects_by_hash.
+var objectHashAlgorithms = []string{"sha512", "imphash", "section", "elf_import_hash"}
+
+// objectHashes returns the hashes of an object which are looked up in
+// objects_by_hash, by algorithm.
+func objectHashes(obj *Object) map[string][]string {
+	hashes := make(map[string][]string)
+	if obj.SHA512 != "" {
+		hashes["sha512"] = []string{obj.SHA512}
+	}
+	if obj.FileImphash != "" {
+		hashes["imphash"] = []string{obj.FileImphash}
+	}
+	if len(obj.FileSectionHashes) > 0 {
+		// sections are found by their md5, whatever their name
+		for _, section := range obj.FileSectionHashes {
+			hashes["section"] = append(hashes["section"], section[strings.LastIndex(section, ":")+1:])
+		}
+	}
+	if obj.FileELFImportHash != "" {
+		hashes["elf_import_hash"] = []string{obj.FileELFImportHash}
+	}
+
+	return hashes
+}
+
+func (s *Cassandra) objectHashIndex(obj *Object) error {
+	for algorithm, hashes := range objectHashes(obj) {
+		for _, hash := range hashes {
+			err := s.DB.Query(`INSERT INTO objects_by_hash (algorithm, hash, sha256) VALUES (?, ?, ?)`, algorithm, hash, obj.SHA256).Exec()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Cassandra) objectSearchByHash(algorithm, hash, mime string, limit int) ([]*Object, error) {
+	objects := []*Object{}
+
+	var ids []string
+	var id string
+	iter := s.DB.Query(`SELECT sha256 FROM objects_by_hash WHERE algorithm = ? AND hash = ? LIMIT ?`, algorithm, hash, limit).Iter()
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	if err := iter.Close(); err != nil {
+		return objects, err
+	}
+
+	for _, id := range ids {
+		object, err := s.ObjectGet(id)
+		if err != nil {
+			return objects, err
+		}
+		if mime == "" || object.FileMime == mime {
+			objects = append(objects, object)
+		}
+	}
+
+	return objects, nil
 }
 
 func (s *Cassandra) ObjectDelete(sha256 string) error {
 	return s.DB.Query(`DELETE FROM objects WHERE sha256 = ?`, sha256).Exec()
 }
 
+// ObjectUpdate recomputes the fields of an object which are aggregated
+// from its submissions, e.g. after submissions were deleted.
 func (s *Cassandra) ObjectUpdate(sha256 string) error {
-	return errors.New("Not implemented")
+	if err := s.updateSubmissions(sha256); err != nil {
+		return err
+	}
+
+	_, err := s.updateObjectTags(sha256)
+	return err
+}
+
+func (s *Cassandra) ObjectGenericDataStore(sha256, relAddress string) error {
+	object, err := s.ObjectGet(sha256)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Query(`UPDATE objects SET generic_data_rel_address = ? WHERE sha256 = ? AND type = ? AND creation_date_time = ?`,
+		relAddress,
+		object.SHA256,
+		object.Type,
+		object.CreationDateTime,
+	).Exec()
 }
 
 func (s *Cassandra) updateSubmissions(sha256 string) error {
@@ -480,39 +458,73 @@ func (s *Cassandra) updateSubmissions(sha256 string) error {
 		return err
 	}
 
+	// an object without submissions left keeps its row, e.g. for its
+	// results, but loses the aggregated fields
 	l := len(submissions)
-	if l == 0 {
-		// TODO: remove the entry, if it exists?
-		return errors.New("Tried to update an object which was never submited!")
+
+	object, err := s.ObjectGet(sha256)
+	if err != nil {
+		return err
 	}
 
 	source := make([]string, l)
-	obj_name := make([]string, l)
+	file_name := make([]string, l)
 	submission_ids := make([]string, l)
 	for k, v := range submissions {
 		source[k] = v.Source
-		obj_name[k] = v.ObjName
+		file_name[k] = v.ObjName
 		submission_ids[k] = v.Id
 	}
 
-	err = s.DB.Query(`UPDATE objects SET source = ?,  obj_name = ?, submissions = ? WHERE sha256 = ?`,
+	err = s.DB.Query(`UPDATE objects SET source = ?,  file_name = ?, submissions = ? WHERE sha256 = ? AND type = ? AND creation_date_time = ?`,
 		source,
-		obj_name,
+		file_name,
 		submission_ids,
-		sha256,
+		object.SHA256,
+		object.Type,
+		object.CreationDateTime,
 	).Exec()
 	return err
 }
 
 func (s *Cassandra) ResultGet(id string) (*Result, error) {
-	result := &Result{}
+	key, err := s.resultKey(id)
+	if err != nil {
+		return &Result{}, err
+	}
+
+	return resultScan(s.DB.Query("SELECT "+resultColumns+" FROM results WHERE service_name = ? AND object_type = ? AND id = ? AND service_version = ?", key...))
+}
 
+// resultKey looks up the primary key of a result in results_by_id, in
+// the order of the columns: service_name, object_type, id and
+// service_version.
+func (s *Cassandra) resultKey(id string) ([]interface{}, error) {
 	uuid, err := gocql.ParseUUID(id)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
 
-	err = s.DB.Query("SELECT id, sha256, schema_version, user_id, source_id, source_tag, service_name, service_version, service_config, object_category, object_type, results, tags, execution_time, watchguard_status, watchguard_log, watchguard_version, comment FROM results WHERE id = ? LIMIT 1", uuid).Scan(
+	var serviceName, objectType, serviceVersion string
+	err = s.DB.Query("SELECT service_name, object_type, service_version FROM results_by_id WHERE id = ? LIMIT 1", uuid).Scan(
+		&serviceName,
+		&objectType,
+		&serviceVersion,
+	)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return []interface{}{serviceName, objectType, uuid, serviceVersion}, nil
+}
+
+const resultColumns = "id, sha256, schema_version, user_id, source_id, source_tag, service_name, service_version, service_config, object_category, object_type, results, tags, execution_time, watchguard_status, watchguard_log, watchguard_version, comment, superseded_by"
+
+// resultScan reads the resultColumns of a single result.
+func resultScan(query *gocql.Query) (*Result, error) {
+	result := &Result{}
+
+	err := query.Scan(
 		&result.Id,
 		&result.SHA256,
 		&result.SchemaVersion,
@@ -531,13 +543,15 @@ func (s *Cassandra) ResultGet(id string) (*Result, error) {
 		&result.WatchguardLog,
 		&result.WatchguardVersion,
 		&result.Comment,
+		&result.SupersededBy,
 	)
 
-	return result, err
+	return result, notFound(err)
 }
 
 func (s *Cassandra) ResultStore(res *Result) error {
 	id := gocql.TimeUUID()
+	res.Id = id.String()
 
 	err := s.DB.Query("INSERT INTO results (id, sha256, schema_version, user_id, source_id, source_tag, service_name, service_version, service_config, object_category, object_type, results, tags, execution_time, watchguard_status, watchguard_log, watchguard_version, comment) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		id,
@@ -559,8 +573,15 @@ func (s *Cassandra) ResultStore(res *Result) error {
 		res.WatchguardVersion,
 		res.Comment,
 	).Exec()
+	if err != nil {
+		return err
+	}
 
-	return err
+	if err = s.tagIndexAdd("result", res.Id, res.ExecutionTime, res.Tags); err != nil {
+		return err
+	}
+
+	return s.resultLatestUpdate(res)
 }
 
 func (s *Cassandra) ResultSearch(searchRes *Result, limit int) ([]*Result, error) {
@@ -568,7 +589,12 @@ func (s *Cassandra) ResultSearch(searchRes *Result, limit int) ([]*Result, error
 }
 
 func (s *Cassandra) ResultDelete(id string) error {
-	return s.DB.Query(`DELETE FROM results WHERE id = ?`, id).Exec()
+	key, err := s.resultKey(id)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Query(`DELETE FROM results WHERE service_name = ? AND object_type = ? AND id = ? AND service_version = ?`, key...).Exec()
 }
 
 func (s *Cassandra) SubmissionGet(id string) (submission *Submission, err error) {
@@ -589,7 +615,7 @@ func (s *Cassandra) SubmissionGet(id string) (submission *Submission, err error)
 		return submission, err
 	}
 
-	err = s.DB.Query("SELECT id, sha256, user_id, source, date_time, obj_name, tags, comment FROM submissions WHERE id = ? LIMIT 1", uuid).Scan(
+	err = s.DB.Query("SELECT id, sha256, user_id, source, date_time, obj_name, tags, comment FROM submissions_by_id WHERE id = ? LIMIT 1", uuid).Scan(
 		&submission.Id,
 		&submission.SHA256,
 		&submission.UserId,
@@ -604,7 +630,7 @@ func (s *Cassandra) SubmissionGet(id string) (submission *Submission, err error)
 		panic("connection broke")
 	}
 
-	return submission, err
+	return submission, notFound(err)
 }
 
 func (s *Cassandra) SubmissionStore(sub *Submission) error {
@@ -621,23 +647,64 @@ func (s *Cassandra) SubmissionStore(sub *Submission) error {
 		sub.Tags,
 		sub.Comment,
 	).Exec()
+	if err != nil {
+		return err
+	}
 
-	return err
+	return s.tagIndexAdd("submission", sub.Id, sub.DateTime, sub.Tags)
 }
 
+// SubmissionSearch finds submissions by the user or the source they came
+// from. If both are given the user is looked up and the results are
+// filtered by the source.
 func (s *Cassandra) SubmissionSearch(searchSub *Submission, limit int) ([]*Submission, error) {
-	return nil, errors.New("Not implemented")
+	submissions := []*Submission{}
+	submission := &Submission{}
+
+	var iter *gocql.Iter
+	if searchSub.UserId != "" {
+		iter = s.DB.Query("SELECT id, sha256, user_id, source, date_time, obj_name, tags, comment FROM submissions_by_user_id WHERE user_id = ? LIMIT ?", searchSub.UserId, limit).Iter()
+	} else if searchSub.Source != "" {
+		iter = s.DB.Query("SELECT id, sha256, user_id, source, date_time, obj_name, tags, comment FROM submissions_by_source WHERE source = ? LIMIT ?", searchSub.Source, limit).Iter()
+	} else {
+		return submissions, errors.New("Submissions can only be searched by user_id or source")
+	}
+
+	for iter.Scan(
+		&submission.Id,
+		&submission.SHA256,
+		&submission.UserId,
+		&submission.Source,
+		&submission.DateTime,
+		&submission.ObjName,
+		&submission.Tags,
+		&submission.Comment,
+	) {
+		if searchSub.Source == "" || submission.Source == searchSub.Source {
+			submissions = append(submissions, submission)
+		}
+		submission = &Submission{}
+	}
+
+	err := iter.Close()
+
+	return submissions, err
 }
 
-func (s *Cassandra) SubmissionDelete(id string) error {
-	uuid, err := gocql.ParseUUID(id)
+// SubmissionDelete deletes a submission as it was stored, the object it
+// belongs to has to be updated with ObjectUpdate afterwards.
+func (s *Cassandra) SubmissionDelete(submission *Submission) error {
+	uuid, err := gocql.ParseUUID(submission.Id)
 	if err != nil {
 		return err
 	}
 
-	err = s.DB.Query(`DELETE FROM submissions WHERE id = ?`, uuid).Exec()
+	err = s.DB.Query(`DELETE FROM submissions WHERE sha256 = ? AND id = ?`, submission.SHA256, uuid).Exec()
+	if err != nil {
+		return err
+	}
 
-	return err
+	return s.tagIndexRemove("submission", submission.Id, submission.DateTime, submission.Tags)
 }
 
 func (s *Cassandra) SubmissionsGetByObject(sha256 string) ([]*Submission, error) {
@@ -672,7 +739,7 @@ func (s *Cassandra) ConfigGet(path string) (*Config, error) {
 		&config.FileContents,
 	)
 
-	return config, err
+	return config, notFound(err)
 }
 
 func (s *Cassandra) ConfigStore(config *Config) error {
@@ -683,3 +750,98 @@ func (s *Cassandra) ConfigStore(config *Config) error {
 
 	return err
 }
+
+// RelationStore stores a relation for both objects, a relation which
+// exists already is replaced along with its provenance.
+func (s *Cassandra) RelationStore(rel *Relation) error {
+	batch := s.DB.NewBatch(gocql.LoggedBatch)
+	for _, reverse := range []bool{false, true} {
+		sha256, related := rel.SHA256, rel.Related
+		if reverse {
+			sha256, related = related, sha256
+		}
+
+		batch.Query(`INSERT INTO relations (sha256, reverse, type, related, service, user_id, date_time) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			sha256,
+			reverse,
+			rel.Type,
+			related,
+			rel.Service,
+			rel.UserId,
+			rel.DateTime,
+		)
+	}
+
+	return s.DB.ExecuteBatch(batch)
+}
+
+func (s *Cassandra) RelationsGet(sha256 string) ([]*Relation, error) {
+	relations := []*Relation{}
+	relation := &Relation{}
+	var reverse bool
+
+	iter := s.DB.Query(`SELECT sha256, reverse, type, related, service, user_id, date_time FROM relations WHERE sha256 = ?`, sha256).Iter()
+	for iter.Scan(
+		&relation.SHA256,
+		&reverse,
+		&relation.Type,
+		&relation.Related,
+		&relation.Service,
+		&relation.UserId,
+		&relation.DateTime,
+	) {
+		if reverse {
+			relation.SHA256, relation.Related = relation.Related, relation.SHA256
+		}
+		relations = append(relations, relation)
+		relation = &Relation{}
+	}
+
+	err := iter.Close()
+
+	return relations, err
+}
+
+func (s *Cassandra) FuzzyHashStore(hash *FuzzyHash) error {
+	return s.DB.Query(`INSERT INTO fuzzy_hashes (algorithm, bucket, sha256, hash) VALUES (?, ?, ?, ?)`,
+		hash.Algorithm,
+		hash.Bucket,
+		hash.SHA256,
+		hash.Hash,
+	).Exec()
+}
+
+func (s *Cassandra) FuzzyHashSearch(algorithm, bucket string, limit int) ([]*FuzzyHash, error) {
+	hashes := []*FuzzyHash{}
+	hash := &FuzzyHash{}
+
+	iter := s.DB.Query(`SELECT algorithm, bucket, sha256, hash FROM fuzzy_hashes WHERE algorithm = ? AND bucket = ? LIMIT ?`, algorithm, bucket, limit).Iter()
+	for iter.Scan(
+		&hash.Algorithm,
+		&hash.Bucket,
+		&hash.SHA256,
+		&hash.Hash,
+	) {
+		hashes = append(hashes, hash)
+		hash = &FuzzyHash{}
+	}
+
+	err := iter.Close()
+
+	return hashes, err
+}
+
+func (s *Cassandra) SampleAccessStore(sha256 string, t time.Time) error {
+	return s.DB.Query(`INSERT INTO sample_access (sha256, last_access) VALUES (?, ?)`, sha256, t).Exec()
+}
+
+func (s *Cassandra) SampleAccessGet(sha256 string) (time.Time, error) {
+	var t time.Time
+
+	err := s.DB.Query(`SELECT last_access FROM sample_access WHERE sha256 = ?`, sha256).Scan(&t)
+	if err == gocql.ErrNotFound {
+		return time.Time{}, nil
+	}
+
+	return t, err
+}
@@ -0,0 +1,452 @@
+package dataStorage
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cassandraMigrations is the layout of the database, ordered by version.
+// Every change needs a new migration with the next version, applied
+// migrations must never be changed. Statements use IF NOT EXISTS where
+// Cassandra supports it, so databases which were partly set up by hand can
+// be migrated too.
+//
+// spaces needed in the statements, !NO TABS!
+var cassandraMigrations = []*Migration{
+	{
+		Version:     1,
+		Description: "Results, objects, submissions and config",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS results(
+        id timeuuid,
+        sha256 text,
+        schema_version text,
+        user_id text,
+        source_id set<text>,
+        source_tag set<text>,
+        service_name text,
+        service_version text,
+        service_config text,
+        object_category set<text>,
+        object_type text,
+        results blob,
+        tags set<text>,
+        execution_time timestamp,
+        watchguard_status text,
+        watchguard_log list<text>,
+        watchguard_version text,
+        comment text,
+    PRIMARY KEY ((service_name, object_type), id, service_version))
+    WITH CLUSTERING ORDER BY (id DESC)
+    AND compression = {
+        'enabled': 'true',
+        'class' : 'LZ4Compressor'
+    };`,
+
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS results_meta_by_sha256 AS
+        SELECT id, sha256, schema_version, user_id, source_id, source_tag, service_name, service_version, service_config, object_category, object_type, tags, execution_time, watchguard_status, watchguard_log, watchguard_version, comment FROM results
+        WHERE sha256 IS NOT NULL
+        AND id IS NOT NULL
+        AND service_name IS NOT NULL
+        AND service_version IS NOT NULL
+        AND object_type IS NOT NULL
+        PRIMARY KEY((sha256), id, service_name, service_version, object_type)
+        WITH CLUSTERING ORDER BY (id DESC);`,
+
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS results_data_by_sha256 AS
+        SELECT id, sha256, service_name, service_version, object_type, results FROM results
+        WHERE sha256 IS NOT NULL
+        AND id IS NOT NULL
+        AND service_name IS NOT NULL
+        AND service_version IS NOT NULL
+        AND object_type IS NOT NULL
+        PRIMARY KEY((sha256), id, service_name, service_version, object_type)
+        WITH CLUSTERING ORDER BY (id DESC);`,
+
+			`CREATE TABLE IF NOT EXISTS objects(
+        type text,
+        creation_date_time timestamp,
+        submissions set<timeuuid>,
+        source set<text>,
+
+        md5 text,
+        sha1 text,
+        sha256 text,
+
+        file_mime text,
+        file_name set<text>,
+
+        domain_fqdn text,
+        domain_tld text,
+        domain_sub_domain text,
+
+        ip_address inet,
+        ip_v6 boolean,
+
+        email_address text,
+        email_local_part text,
+        email_domain_part text,
+        email_sub_addressing text,
+
+        generic_identifier text,
+        generic_type text,
+        generic_data_rel_address text,
+    PRIMARY KEY ((sha256), creation_date_time, type))
+    WITH CLUSTERING ORDER BY (creation_date_time DESC)
+    AND compression = {
+        'enabled': 'true',
+        'class' : 'LZ4Compressor'
+    };`,
+
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS objects_by_type_file AS
+        SELECT creation_date_time, submissions, source, md5, sha1, sha256, file_mime, file_name
+        FROM objects
+        WHERE file_mime IS NOT NULL
+        AND creation_date_time IS NOT NULL
+        AND sha256 IS NOT NULL
+        AND type = 'file'
+        PRIMARY KEY((file_mime), creation_date_time, sha256, type)
+        WITH CLUSTERING ORDER BY (creation_date_time DESC);`,
+
+			`CREATE TABLE IF NOT EXISTS submissions(
+        id timeuuid,
+        sha256 text,
+        user_id text,
+        source text,
+        date_time timestamp,
+        obj_name text,
+        tags set<text>,
+        comment text,
+    PRIMARY KEY ((sha256), id))
+    WITH CLUSTERING ORDER BY (id DESC)
+    AND compression = {
+        'enabled': 'true',
+        'class' : 'LZ4Compressor'
+    };`,
+
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS submissions_by_user_id
+        AS SELECT *
+        FROM submissions
+        WHERE user_id IS NOT NULL
+        AND id IS NOT NULL
+        AND sha256 IS NOT NULL
+        PRIMARY KEY((user_id), id, sha256)
+        WITH CLUSTERING ORDER BY (id desc);`,
+
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS submissions_by_source
+        AS SELECT *
+        FROM submissions
+        WHERE source IS NOT NULL
+        AND id IS NOT NULL
+        AND sha256 IS NOT NULL
+        PRIMARY KEY((source), id, sha256)
+        WITH CLUSTERING ORDER BY (id desc);`,
+
+			`CREATE TABLE IF NOT EXISTS config(
+        path text PRIMARY KEY,
+        file_contents text
+    );`,
+
+			//TODO: add complex SASI indexes on tags, object_category, etc when supported by Cassandra
+			//TODO: add indexes for other entries (watchguard_status, user_id, service_version) under results when totem catches up
+
+			// WARNING: a SASI index on results (results) can increase
+			// physical storage costs by ~40% with 1 million samples and 4
+			// Services, add it in an own migration only if needed.
+			`CREATE CUSTOM INDEX IF NOT EXISTS results_comment_idx
+        ON results (comment)
+        USING 'org.apache.cassandra.index.sasi.SASIIndex'
+        WITH OPTIONS = {
+            'analyzed' : 'true',
+            'analyzer_class' : 'org.apache.cassandra.index.sasi.analyzer.StandardAnalyzer',
+            'tokenization_enable_stemming' : 'true',
+            'tokenization_locale' : 'en',
+            'tokenization_normalize_lowercase' : 'true',
+            'tokenization_skip_stop_words' : 'true'
+        };`,
+
+			`CREATE CUSTOM INDEX IF NOT EXISTS objects_md5_idx
+        ON objects (md5)
+        USING 'org.apache.cassandra.index.sasi.SASIIndex';`,
+
+			`CREATE CUSTOM INDEX IF NOT EXISTS submissions_comment_idx
+        ON submissions (comment)
+        USING 'org.apache.cassandra.index.sasi.SASIIndex'
+        WITH OPTIONS = {
+            'analyzed' : 'true',
+            'analyzer_class' : 'org.apache.cassandra.index.sasi.analyzer.StandardAnalyzer',
+            'tokenization_enable_stemming' : 'true',
+            'tokenization_locale' : 'en',
+            'tokenization_normalize_lowercase' : 'true',
+            'tokenization_skip_stop_words' : 'true'
+        };`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "Last access of samples for tiering",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS sample_access(
+        sha256 text PRIMARY KEY,
+        last_access timestamp
+    );`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "Tags of objects and the tag index",
+		Statements: []string{
+			`ALTER TABLE objects ADD tags set<text>;`,
+			`ALTER TABLE objects ADD object_tags set<text>;`,
+			`CREATE TABLE IF NOT EXISTS tags(
+        tag text,
+        entity text,
+        date_time timestamp,
+        id text,
+    PRIMARY KEY ((tag, entity), date_time, id))
+    WITH CLUSTERING ORDER BY (date_time DESC);`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "Relations between objects",
+		Statements: []string{
+			// every relation is stored for both objects, reverse marks the
+			// copy kept for the related object
+			`CREATE TABLE IF NOT EXISTS relations(
+        sha256 text,
+        reverse boolean,
+        type text,
+        related text,
+        service text,
+        user_id text,
+        date_time timestamp,
+    PRIMARY KEY ((sha256), reverse, type, related));`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "TLSH and ssdeep hashes of files",
+		Statements: []string{
+			`ALTER TABLE objects ADD file_tlsh text;`,
+			`ALTER TABLE objects ADD file_ssdeep text;`,
+			`CREATE TABLE IF NOT EXISTS fuzzy_hashes(
+        algorithm text,
+        bucket text,
+        sha256 text,
+        hash text,
+    PRIMARY KEY ((algorithm, bucket), sha256));`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "sha512, imphash, section and ELF import hashes",
+		Statements: []string{
+			`ALTER TABLE objects ADD sha512 text;`,
+			`ALTER TABLE objects ADD file_imphash text;`,
+			`ALTER TABLE objects ADD file_section_hashes list<text>;`,
+			`ALTER TABLE objects ADD file_elf_import_hash text;`,
+			`CREATE TABLE IF NOT EXISTS objects_by_hash(
+        algorithm text,
+        hash text,
+        sha256 text,
+    PRIMARY KEY ((algorithm, hash), sha256));`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "Latest result of every service version",
+		Statements: []string{
+			`ALTER TABLE results ADD superseded_by timeuuid;`,
+			`CREATE TABLE IF NOT EXISTS results_latest(
+        sha256 text,
+        service_name text,
+        service_version text,
+        object_type text,
+        id timeuuid,
+        execution_time timestamp,
+    PRIMARY KEY ((sha256), service_name, service_version));`,
+		},
+	},
+	{
+		Version:     8,
+		Description: "Submissions and results by their id",
+		Statements: []string{
+			// ids alone aren't the partition keys of submissions and
+			// results, these views find them
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS submissions_by_id
+        AS SELECT *
+        FROM submissions
+        WHERE id IS NOT NULL
+        AND sha256 IS NOT NULL
+        PRIMARY KEY((id), sha256);`,
+
+			`CREATE MATERIALIZED VIEW IF NOT EXISTS results_by_id AS
+        SELECT id, service_name, object_type, service_version FROM results
+        WHERE id IS NOT NULL
+        AND service_name IS NOT NULL
+        AND object_type IS NOT NULL
+        AND service_version IS NOT NULL
+        PRIMARY KEY((id), service_name, object_type, service_version);`,
+		},
+	},
+}
+
+// MigrationStatus returns all migrations, the applied ones with the time
+// they were applied.
+func (s *Cassandra) MigrationStatus() ([]*Migration, error) {
+	applied := make(map[int]time.Time)
+
+	// databases set up before the migrations have no schema_version
+	// table, all migrations are pending there
+	exists, err := s.tableExists("schema_version")
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		var (
+			version int
+			t       time.Time
+		)
+		iter := s.DB.Query(`SELECT version, applied FROM schema_version`).Iter()
+		for iter.Scan(&version, &t) {
+			applied[version] = t
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	migrations := make([]*Migration, len(cassandraMigrations))
+	for i, m := range cassandraMigrations {
+		migration := *m
+		migration.Applied = applied[m.Version]
+		migrations[i] = &migration
+	}
+
+	return migrations, nil
+}
+
+// Migrate applies the pending migrations in order and records them in the
+// schema_version table. Columns and indexes which already exist are
+// skipped, they might have been added by hand.
+func (s *Cassandra) Migrate(dryRun bool) ([]*Migration, error) {
+	migrations, err := s.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []*Migration{}
+	for _, m := range migrations {
+		if m.Applied.IsZero() {
+			pending = append(pending, m)
+		}
+	}
+	if dryRun || len(pending) == 0 {
+		return pending, nil
+	}
+
+	tableSchemaVersion := `CREATE TABLE IF NOT EXISTS schema_version(
+        version int PRIMARY KEY,
+        description text,
+        applied timestamp
+    );`
+	if err := s.DB.Query(tableSchemaVersion).Exec(); err != nil {
+		return nil, err
+	}
+
+	for _, m := range pending {
+		for _, stmt := range m.Statements {
+			exists, err := s.schemaExists(stmt)
+			if err == nil && !exists {
+				err = s.DB.Query(stmt).Exec()
+			}
+			if err != nil {
+				return nil, errors.New("Migration " + strconv.Itoa(m.Version) + " failed: " + err.Error())
+			}
+		}
+
+		m.Applied = time.Now()
+		err := s.DB.Query(`INSERT INTO schema_version (version, description, applied) VALUES (?, ?, ?)`,
+			m.Version,
+			m.Description,
+			m.Applied,
+		).Exec()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
+}
+
+var (
+	// ALTER TABLE <table> ADD <column> <type>
+	alterAddColumn = regexp.MustCompile(`(?is)^\s*ALTER\s+TABLE\s+(\w+)\s+ADD\s+(\w+)\s`)
+
+	// CREATE [CUSTOM] INDEX [IF NOT EXISTS] <name> ON <table> (<column>)
+	createIndex = regexp.MustCompile(`(?is)^\s*CREATE\s+(?:CUSTOM\s+)?INDEX\s+(?:IF\s+NOT\s+EXISTS\s+)?\w+\s+ON\s+(\w+)\s*\(\s*(\w+)\s*\)`)
+)
+
+// schemaChange returns the kind ("column" or "index"), table and column
+// of a statement adding a column or index, Cassandra has no IF NOT EXISTS
+// for the former and rejects a second index on a column under another
+// name. Other statements return an empty kind.
+func schemaChange(stmt string) (string, string, string) {
+	if m := alterAddColumn.FindStringSubmatch(stmt); m != nil {
+		return "column", strings.ToLower(m[1]), strings.ToLower(m[2])
+	}
+	if m := createIndex.FindStringSubmatch(stmt); m != nil {
+		return "index", strings.ToLower(m[1]), strings.ToLower(m[2])
+	}
+
+	return "", "", ""
+}
+
+// schemaExists reports whether the column or index a statement adds is
+// already in the schema. Statements creating tables and views use IF NOT
+// EXISTS instead.
+func (s *Cassandra) schemaExists(stmt string) (bool, error) {
+	kind, table, column := schemaChange(stmt)
+
+	switch kind {
+	case "column":
+		var name string
+		iter := s.DB.Query(`SELECT column_name FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ? AND column_name = ?`,
+			s.keyspace(), table, column).Iter()
+		found := iter.Scan(&name)
+		return found, iter.Close()
+
+	case "index":
+		var options map[string]string
+		exists := false
+		iter := s.DB.Query(`SELECT options FROM system_schema.indexes WHERE keyspace_name = ? AND table_name = ?`,
+			s.keyspace(), table).Iter()
+		for iter.Scan(&options) {
+			if strings.ToLower(options["target"]) == column {
+				exists = true
+			}
+		}
+		return exists, iter.Close()
+	}
+
+	return false, nil
+}
+
+// tableExists looks a table up in the schema of the keyspace.
+func (s *Cassandra) tableExists(table string) (bool, error) {
+	var name string
+	iter := s.DB.Query(`SELECT table_name FROM system_schema.tables WHERE keyspace_name = ? AND table_name = ?`,
+		s.keyspace(), table).Iter()
+	found := iter.Scan(&name)
+
+	return found, iter.Close()
+}
+
+func (s *Cassandra) keyspace() string {
+	return connectionData[0].Database
+}
@@ -0,0 +1,50 @@
+package dataStorage
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestSchemaChange(t *testing.T) {
+	tests := []struct {
+		stmt                string
+		kind, table, column string
+	}{
+		{`ALTER TABLE objects ADD file_tlsh text;`, "column", "objects", "file_tlsh"},
+		{`ALTER TABLE objects ADD file_section_hashes list<text>;`, "column", "objects", "file_section_hashes"},
+		{`alter table Results add Superseded_By timeuuid;`, "column", "results", "superseded_by"},
+		{`CREATE CUSTOM INDEX IF NOT EXISTS objects_md5_idx
+        ON objects (md5)
+        USING 'org.apache.cassandra.index.sasi.SASIIndex';`, "index", "objects", "md5"},
+		{`CREATE INDEX tags_idx ON objects(tags);`, "index", "objects", "tags"},
+		{`CREATE TABLE IF NOT EXISTS sample_access(
+        sha256 text PRIMARY KEY,
+        last_access timestamp
+    );`, "", "", ""},
+		{`CREATE MATERIALIZED VIEW IF NOT EXISTS submissions_by_id
+        AS SELECT * FROM submissions`, "", "", ""},
+	}
+
+	for _, test := range tests {
+		kind, table, column := schemaChange(test.stmt)
+		if kind != test.kind || table != test.table || column != test.column {
+			t.Errorf("%q: got %q %q %q, expected %q %q %q", test.stmt, kind, table, column, test.kind, test.table, test.column)
+		}
+	}
+}
+
+var createIfNotExists = regexp.MustCompile(`(?is)^\s*CREATE\s+(?:TABLE|MATERIALIZED\s+VIEW)\s+IF\s+NOT\s+EXISTS\s`)
+
+// TestSchemaChangeMigrations makes sure every statement of the migrations
+// adding a column or index is recognized, otherwise a column added by
+// hand breaks the migration.
+func TestSchemaChangeMigrations(t *testing.T) {
+	for _, m := range cassandraMigrations {
+		for _, stmt := range m.Statements {
+			kind, _, _ := schemaChange(stmt)
+			if kind == "" && !createIfNotExists.MatchString(stmt) {
+				t.Errorf("migration %d: %q is neither idempotent nor checked against the schema", m.Version, stmt)
+			}
+		}
+	}
+}
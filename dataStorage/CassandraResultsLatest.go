@@ -0,0 +1,248 @@
+package dataStorage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// resultLatest is an entry of the results_latest table, the newest result
+// of a service version for an object.
+type resultLatest struct {
+	ServiceName    string
+	ServiceVersion string
+	ObjectType     string
+	Id             gocql.UUID
+	ExecutionTime  time.Time
+}
+
+// newer reports whether a result executed at t with the id replaces the
+// entry, results executed at the same time are ordered by their ids.
+func (l *resultLatest) newer(t time.Time, id gocql.UUID) bool {
+	if t.Equal(l.ExecutionTime) {
+		return id.Time().After(l.Id.Time())
+	}
+
+	return t.After(l.ExecutionTime)
+}
+
+// resultsLatestGet returns the entries of an object, of all services if
+// serviceName is empty.
+func (s *Cassandra) resultsLatestGet(sha256, serviceName string) ([]*resultLatest, error) {
+	entries := []*resultLatest{}
+
+	query := `SELECT service_name, service_version, object_type, id, execution_time FROM results_latest WHERE sha256 = ?`
+	args := []interface{}{sha256}
+	if serviceName != "" {
+		query += ` AND service_name = ?`
+		args = append(args, serviceName)
+	}
+
+	entry := &resultLatest{}
+	iter := s.DB.Query(query, args...).Iter()
+	for iter.Scan(
+		&entry.ServiceName,
+		&entry.ServiceVersion,
+		&entry.ObjectType,
+		&entry.Id,
+		&entry.ExecutionTime,
+	) {
+		entries = append(entries, entry)
+		entry = &resultLatest{}
+	}
+
+	err := iter.Close()
+
+	return entries, err
+}
+
+// resultLatestUpdate records a stored result in results_latest. The
+// entries of an object are complete once it has any, so the first result
+// stored for an object without entries indexes all its older results,
+// e.g. the ones stored before the table existed.
+func (s *Cassandra) resultLatestUpdate(res *Result) error {
+	entries, err := s.resultsLatestGet(res.SHA256, "")
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		if _, err = s.resultsLatestRebuild(res.SHA256); err != nil {
+			return err
+		}
+	}
+
+	// the view used by the rebuild might not contain the result yet
+	return s.resultLatestIndex(res)
+}
+
+// resultLatestIndex records a result as the newest one of its service
+// version if no newer one is known. The current result of the service,
+// the newest over all versions, is marked as superseded by the result, or
+// the result by the current one if it is older.
+func (s *Cassandra) resultLatestIndex(res *Result) error {
+	id, err := gocql.ParseUUID(res.Id)
+	if err != nil {
+		return err
+	}
+
+	var current *resultLatest
+	for {
+		entries, err := s.resultsLatestGet(res.SHA256, res.ServiceName)
+		if err != nil {
+			return err
+		}
+
+		var version *resultLatest
+		current = nil
+		for _, entry := range entries {
+			if current == nil || current.newer(entry.ExecutionTime, entry.Id) {
+				current = entry
+			}
+			if entry.ServiceVersion == res.ServiceVersion {
+				version = entry
+			}
+		}
+
+		applied, err := s.resultLatestSet(res, id, version)
+		if err != nil {
+			return err
+		}
+		if applied {
+			break
+		}
+		// another result of the version was recorded meanwhile, compare
+		// with that one
+	}
+
+	if current == nil || current.Id == id {
+		return nil
+	}
+	if current.newer(res.ExecutionTime, id) {
+		return s.resultSupersede(current.ServiceName, current.ObjectType, current.Id, current.ServiceVersion, id)
+	}
+
+	res.SupersededBy = current.Id.String()
+	return s.resultSupersede(res.ServiceName, res.ObjectType, id, res.ServiceVersion, current.Id)
+}
+
+// resultLatestSet replaces the entry of the service version read before,
+// nil if there was none, by the result if it is newer. The writes are
+// lightweight transactions, so an entry written by a concurrent store in
+// the meantime isn't overwritten; false is returned then.
+func (s *Cassandra) resultLatestSet(res *Result, id gocql.UUID, version *resultLatest) (bool, error) {
+	if version == nil {
+		return s.DB.Query(`INSERT INTO results_latest (sha256, service_name, service_version, object_type, id, execution_time) VALUES (?, ?, ?, ?, ?, ?) IF NOT EXISTS`,
+			res.SHA256,
+			res.ServiceName,
+			res.ServiceVersion,
+			res.ObjectType,
+			id,
+			res.ExecutionTime,
+		).MapScanCAS(make(map[string]interface{}))
+	}
+
+	if !version.newer(res.ExecutionTime, id) {
+		return true, nil
+	}
+
+	return s.DB.Query(`UPDATE results_latest SET object_type = ?, id = ?, execution_time = ? WHERE sha256 = ? AND service_name = ? AND service_version = ? IF id = ?`,
+		res.ObjectType,
+		id,
+		res.ExecutionTime,
+		res.SHA256,
+		res.ServiceName,
+		res.ServiceVersion,
+		version.Id,
+	).MapScanCAS(make(map[string]interface{}))
+}
+
+func (s *Cassandra) resultSupersede(serviceName, objectType string, id gocql.UUID, serviceVersion string, by gocql.UUID) error {
+	return s.DB.Query(`UPDATE results SET superseded_by = ? WHERE service_name = ? AND object_type = ? AND id = ? AND service_version = ?`,
+		by,
+		serviceName,
+		objectType,
+		id,
+		serviceVersion,
+	).Exec()
+}
+
+// resultsLatestRebuild fills the results_latest table for an object from
+// all its results, e.g. for results stored before the table existed.
+func (s *Cassandra) resultsLatestRebuild(sha256 string) ([]*resultLatest, error) {
+	results := []*Result{}
+
+	result := &Result{SHA256: sha256}
+	iter := s.DB.Query(`SELECT id, service_name, service_version, object_type, execution_time FROM results_meta_by_sha256 WHERE sha256 = ?`, sha256).Iter()
+	for iter.Scan(
+		&result.Id,
+		&result.ServiceName,
+		&result.ServiceVersion,
+		&result.ObjectType,
+		&result.ExecutionTime,
+	) {
+		results = append(results, result)
+		result = &Result{SHA256: sha256}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	// in the order of execution, every result supersedes the previous one
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ExecutionTime.Before(results[j].ExecutionTime)
+	})
+	for _, result := range results {
+		if err := s.resultLatestIndex(result); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.resultsLatestGet(sha256, "")
+}
+
+// ResultsLatest returns the current results of an object ordered by the
+// service name. Objects without any entry in results_latest, which got no
+// result since the table exists, are indexed from all their results
+// first.
+func (s *Cassandra) ResultsLatest(sha256 string, perVersion bool) ([]*Result, error) {
+	entries, err := s.resultsLatestGet(sha256, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		if entries, err = s.resultsLatestRebuild(sha256); err != nil {
+			return nil, err
+		}
+	}
+
+	if !perVersion {
+		newest := []*resultLatest{}
+		for _, entry := range entries {
+			last := len(newest) - 1
+			switch {
+			case last < 0 || newest[last].ServiceName != entry.ServiceName:
+				newest = append(newest, entry)
+			case newest[last].newer(entry.ExecutionTime, entry.Id):
+				newest[last] = entry
+			}
+		}
+		entries = newest
+	}
+
+	results := make([]*Result, 0, len(entries))
+	for _, entry := range entries {
+		result, err := resultScan(s.DB.Query("SELECT "+resultColumns+" FROM results WHERE service_name = ? AND object_type = ? AND id = ? AND service_version = ?",
+			entry.ServiceName,
+			entry.ObjectType,
+			entry.Id,
+			entry.ServiceVersion,
+		))
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
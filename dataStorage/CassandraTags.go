@@ -0,0 +1,223 @@
+package dataStorage
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// TagsAdd tags an entity. Tags of objects are kept apart from the ones of
+// their submissions (object_tags), the tags column of an object always
+// holds both.
+func (s *Cassandra) TagsAdd(entity, id string, tags []string) error {
+	return s.tagsChange(entity, id, tags, "+")
+}
+
+func (s *Cassandra) TagsRemove(entity, id string, tags []string) error {
+	return s.tagsChange(entity, id, tags, "-")
+}
+
+func (s *Cassandra) tagsChange(entity, id string, tags []string, op string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	index := s.tagIndexAdd
+	if op == "-" {
+		index = s.tagIndexRemove
+	}
+
+	switch entity {
+	case "object":
+		object, err := s.ObjectGet(id)
+		if err != nil {
+			return err
+		}
+
+		err = s.DB.Query(`UPDATE objects SET object_tags = object_tags `+op+` ? WHERE sha256 = ? AND type = ? AND creation_date_time = ?`,
+			tags,
+			object.SHA256,
+			object.Type,
+			object.CreationDateTime,
+		).Exec()
+		if err != nil {
+			return err
+		}
+
+		_, err = s.updateObjectTags(object.SHA256)
+		return err
+
+	case "submission":
+		submission, err := s.SubmissionGet(id)
+		if err != nil {
+			return err
+		}
+		uuid, err := gocql.ParseUUID(submission.Id)
+		if err != nil {
+			return err
+		}
+
+		err = s.DB.Query(`UPDATE submissions SET tags = tags `+op+` ? WHERE sha256 = ? AND id = ?`,
+			tags,
+			submission.SHA256,
+			uuid,
+		).Exec()
+		if err != nil {
+			return err
+		}
+
+		if err = index("submission", submission.Id, submission.DateTime, tags); err != nil {
+			return err
+		}
+
+		_, err = s.updateObjectTags(submission.SHA256)
+		return err
+
+	case "result":
+		result, err := s.ResultGet(id)
+		if err != nil {
+			return err
+		}
+		uuid, err := gocql.ParseUUID(result.Id)
+		if err != nil {
+			return err
+		}
+
+		err = s.DB.Query(`UPDATE results SET tags = tags `+op+` ? WHERE service_name = ? AND object_type = ? AND id = ? AND service_version = ?`,
+			tags,
+			result.ServiceName,
+			result.ObjectType,
+			uuid,
+			result.ServiceVersion,
+		).Exec()
+		if err != nil {
+			return err
+		}
+
+		return index("result", result.Id, result.ExecutionTime, tags)
+	}
+
+	return errors.New("Unknown entity: " + entity)
+}
+
+// updateObjectTags sets the tags of an object to its own tags and the ones
+// of all its submissions and updates the tag index accordingly.
+func (s *Cassandra) updateObjectTags(sha256 string) ([]string, error) {
+	object, err := s.ObjectGet(sha256)
+	if err != nil {
+		return nil, err
+	}
+
+	var own []string
+	err = s.DB.Query(`SELECT object_tags FROM objects WHERE sha256 = ? LIMIT 1`, sha256).Scan(&own)
+	if err != nil {
+		return nil, err
+	}
+
+	submissions, err := s.SubmissionsGetByObject(sha256)
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	for _, tag := range own {
+		set[tag] = true
+	}
+	for _, submission := range submissions {
+		for _, tag := range submission.Tags {
+			set[tag] = true
+		}
+	}
+
+	tags := make([]string, 0, len(set))
+	for tag := range set {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	var removed []string
+	for _, tag := range object.Tags {
+		if !set[tag] {
+			removed = append(removed, tag)
+		}
+	}
+
+	err = s.DB.Query(`UPDATE objects SET tags = ? WHERE sha256 = ? AND type = ? AND creation_date_time = ?`,
+		tags,
+		object.SHA256,
+		object.Type,
+		object.CreationDateTime,
+	).Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	// entries are written again for all tags, this also indexes objects
+	// which were tagged before the index existed
+	if err = s.tagIndexAdd("object", sha256, object.CreationDateTime, tags); err != nil {
+		return nil, err
+	}
+	if err = s.tagIndexRemove("object", sha256, object.CreationDateTime, removed); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+func (s *Cassandra) tagIndexAdd(entity, id string, t time.Time, tags []string) error {
+	for _, tag := range tags {
+		err := s.DB.Query(`INSERT INTO tags (tag, entity, date_time, id) VALUES (?, ?, ?, ?)`, tag, entity, t, id).Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Cassandra) tagIndexRemove(entity, id string, t time.Time, tags []string) error {
+	for _, tag := range tags {
+		err := s.DB.Query(`DELETE FROM tags WHERE tag = ? AND entity = ? AND date_time = ? AND id = ?`, tag, entity, t, id).Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TagSearch returns the newest entities with the tag first.
+func (s *Cassandra) TagSearch(entity, tag string, from, to time.Time, limit int) ([]*Tagged, error) {
+	entries := []*Tagged{}
+
+	query := `SELECT tag, entity, date_time, id FROM tags WHERE tag = ? AND entity = ?`
+	args := []interface{}{tag, entity}
+	if !from.IsZero() {
+		query += ` AND date_time >= ?`
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		query += ` AND date_time <= ?`
+		args = append(args, to)
+	}
+	query += ` LIMIT ?`
+	args = append(args, limit)
+
+	entry := &Tagged{}
+	iter := s.DB.Query(query, args...).Iter()
+	for iter.Scan(
+		&entry.Tag,
+		&entry.Entity,
+		&entry.DateTime,
+		&entry.Id,
+	) {
+		entries = append(entries, entry)
+		entry = &Tagged{}
+	}
+
+	err := iter.Close()
+
+	return entries, err
+}
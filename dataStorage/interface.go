@@ -1,6 +1,7 @@
 package dataStorage
 
 import (
+	"errors"
 	"time"
 )
 
@@ -12,6 +13,10 @@ implementation add a wrapper to your specific storer file,
 don't change these structs here!
 */
 
+// ErrNotFound is returned by the getters if the requested entry
+// doesn't exist in the database.
+var ErrNotFound = errors.New("not found")
+
 type Connector struct {
 	Engine   string
 	IP       string
@@ -30,11 +35,23 @@ type Storage interface {
 	Initialize([]*Connector) error
 
 	// Is called to setup the db on the very first run
-	// to create initial collections and tables (if necessary)
+	// to create initial collections and tables (if necessary),
+	// on existing dbs it applies the pending migrations
 	Setup() error
 
+	// Every engine ships its own migrations of the db layout.
+	// MigrationStatus returns all of them, Migrate applies the
+	// pending ones in order and returns them. With dryRun
+	// nothing is applied.
+	MigrationStatus() ([]*Migration, error)
+	Migrate(dryRun bool) ([]*Migration, error)
+
 	Recover()
 
+	// Checks that the db is reachable and answers queries,
+	// called by the readiness check
+	Ping() error
+
 	// The functions below are abstractions of the database
 	// layout Holmes is using.
 
@@ -44,22 +61,51 @@ type Storage interface {
 	ObjectSearch(searchObj *Object, limit int) ([]*Object, error)
 	ObjectDelete(sha256 string) error
 	ObjectUpdate(sha256 string) error
+	ObjectGenericDataStore(sha256, relAddress string) error // Records where the payload of a generic object is kept in the object storage.
 
 	//-- Results
 	ResultGet(id string) (*Result, error)
 	ResultStore(res *Result) error
 	ResultSearch(searchRes *Result, limit int) ([]*Result, error)
 	ResultDelete(id string) error
+	ResultsLatest(sha256 string, perVersion bool) ([]*Result, error) // The newest result (by execution time) of every service, or of every service version if perVersion is set.
 
 	//-- Submissions
 	SubmissionGet(id string) (*Submission, error)
+	SubmissionsGetByObject(sha256 string) ([]*Submission, error)
 	SubmissionStore(sub *Submission) error
 	SubmissionSearch(searchSub *Submission, limit int) ([]*Submission, error)
-	SubmissionDelete(id string) error
+	SubmissionDelete(sub *Submission) error
 
 	//-- Config
 	ConfigGet(path string) (*Config, error)
 	ConfigStore(conf *Config) error
+
+	//-- Tags, entity is one of "object", "submission" or "result". Tags of
+	// submissions are aggregated into the tags of their object.
+	TagsAdd(entity, id string, tags []string) error
+	TagsRemove(entity, id string, tags []string) error
+	TagSearch(entity, tag string, from, to time.Time, limit int) ([]*Tagged, error) // A zero from or to leaves the time range open.
+
+	//-- Relations between objects
+	RelationStore(rel *Relation) error
+	RelationsGet(sha256 string) ([]*Relation, error) // relations from and to the object
+
+	//-- Fuzzy hashes, grouped into buckets of hashes which can be similar
+	FuzzyHashStore(hash *FuzzyHash) error
+	FuzzyHashSearch(algorithm, bucket string, limit int) ([]*FuzzyHash, error)
+
+	//-- Sample access, used to move unused samples to cold storage
+	SampleAccessStore(sha256 string, t time.Time) error
+	SampleAccessGet(sha256 string) (time.Time, error) // Returns the zero time if the sample was never accessed.
+}
+
+// Migration is a versioned change of the db layout.
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string  // in the query language of the engine
+	Applied     time.Time // zero if the migration is pending
 }
 
 type Object struct {
@@ -71,9 +117,16 @@ type Object struct {
 	MD5    string `json:"md5"`
 	SHA1   string `json:"sha1"`
 	SHA256 string `json:"sha256"`
+	SHA512 string `json:"sha512"`
 
-	FileMime string   `json:"file_mime"`
-	FileName []string `json:"file_name"`
+	FileMime   string   `json:"file_mime"`
+	FileName   []string `json:"file_name"`
+	FileTLSH   string   `json:"file_tlsh"`
+	FileSSDeep string   `json:"file_ssdeep"`
+
+	FileImphash       string   `json:"file_imphash"`
+	FileSectionHashes []string `json:"file_section_hashes"` // "name:md5" of every PE section
+	FileELFImportHash string   `json:"file_elf_import_hash"`
 
 	DomainFQDN      string `json:"domain_fqdn"`
 	DomainTLD       string `json:"domain_tld"`
@@ -90,6 +143,8 @@ type Object struct {
 	GenericIdentifier     string `json:"generic_identifier"`
 	GenericType           string `json:"generic_type"`
 	GenericDataRelAddress string `json:"generic_data_rel_address"`
+
+	Tags []string `json:"tags"` // own tags and the ones of all submissions
 }
 
 type Submission struct {
@@ -122,6 +177,42 @@ type Result struct {
 	WatchguardLog     []string  `json:"watchguard_log"`
 	WatchguardVersion string    `json:"watchguard_version"`
 	Comment           string    `json:"comment"`
+	SupersededBy      string    `json:"superseded_by"` // id of the newer result of the service which replaced this one
+}
+
+// Tagged is an entry of the tag index. DateTime is the time of the tagged
+// entity: the creation of objects, the date of submissions and the
+// execution of results.
+type Tagged struct {
+	Tag      string    `json:"tag"`
+	Entity   string    `json:"entity"`
+	Id       string    `json:"id"`
+	DateTime time.Time `json:"date_time"`
+}
+
+// RelationTypes are the known kinds of relations.
+var RelationTypes = []string{"dropped-by", "extracted-from", "contacted", "attachment-of"}
+
+// Relation links two objects and reads "SHA256 Type Related", e.g. a file
+// dropped-by the sample which dropped it, a file extracted-from an archive,
+// a sample which contacted a domain or ip or a file which is an
+// attachment-of an email. Service or UserId record who created it.
+type Relation struct {
+	SHA256   string    `json:"sha256"`
+	Type     string    `json:"type"`
+	Related  string    `json:"related"`
+	Service  string    `json:"service,omitempty"`
+	UserId   string    `json:"user_id,omitempty"`
+	DateTime time.Time `json:"date_time"`
+}
+
+// FuzzyHash is an entry of the fuzzy hash index, Algorithm is "tlsh" or
+// "ssdeep".
+type FuzzyHash struct {
+	Algorithm string `json:"algorithm"`
+	Bucket    string `json:"bucket"`
+	SHA256    string `json:"sha256"`
+	Hash      string `json:"hash"`
 }
 
 type Config struct {
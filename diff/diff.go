@@ -0,0 +1,140 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// Change is a difference between two JSON documents at Path, a JSON
+// pointer (RFC 6901). Old is missing for added values, New for removed
+// ones.
+type Change struct {
+	Path string      `json:"path"`
+	Kind string      `json:"kind"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+
+	pattern string
+}
+
+// Pattern is the path with all array indices replaced by "*", so changes
+// of the same field in different documents can be grouped.
+func (c *Change) Pattern() string {
+	return c.pattern
+}
+
+// JSON returns the changes from document a to document b, ordered by
+// path. Objects are compared key by key and arrays element by element. A
+// document which isn't valid JSON is compared as a whole string.
+func JSON(a, b []byte) []*Change {
+	changes := []*Change{}
+	compare("", "", decode(a), decode(b), &changes)
+
+	return changes
+}
+
+func decode(data []byte) interface{} {
+	var v interface{}
+
+	// numbers are kept as they are written, floats would round them
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil || d.More() {
+		return string(data)
+	}
+
+	return v
+}
+
+func compare(path, pattern string, a, b interface{}, changes *[]*Change) {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(x)+len(y))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		for k := range y {
+			if _, ok := x[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			p, pp := path+"/"+escape(k), pattern+"/"+escape(k)
+			va, inA := x[k]
+			vb, inB := y[k]
+			switch {
+			case !inB:
+				*changes = append(*changes, &Change{Path: p, Kind: Removed, Old: va, pattern: pp})
+			case !inA:
+				*changes = append(*changes, &Change{Path: p, Kind: Added, New: vb, pattern: pp})
+			default:
+				compare(p, pp, va, vb, changes)
+			}
+		}
+		return
+
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+
+		for i := 0; i < len(x) || i < len(y); i++ {
+			p, pp := path+"/"+strconv.Itoa(i), pattern+"/*"
+			switch {
+			case i >= len(y):
+				*changes = append(*changes, &Change{Path: p, Kind: Removed, Old: x[i], pattern: pp})
+			case i >= len(x):
+				*changes = append(*changes, &Change{Path: p, Kind: Added, New: y[i], pattern: pp})
+			default:
+				compare(p, pp, x[i], y[i], changes)
+			}
+		}
+		return
+	}
+
+	if !equal(a, b) {
+		*changes = append(*changes, &Change{Path: path, Kind: Changed, Old: a, New: b, pattern: pattern})
+	}
+}
+
+// equal compares two values which aren't both objects or arrays, numbers
+// are equal if their values are, e.g. 1 and 1.0. They are compared with
+// more precision than float64 has, so large ids don't look equal.
+func equal(a, b interface{}) bool {
+	x, okA := a.(json.Number)
+	y, okB := b.(json.Number)
+	if okA && okB && x != y {
+		fx, okX := new(big.Float).SetPrec(numberPrecision).SetString(string(x))
+		fy, okY := new(big.Float).SetPrec(numberPrecision).SetString(string(y))
+		return okX && okY && fx.Cmp(fy) == 0
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// numberPrecision is the mantissa in bits numbers are compared with.
+const numberPrecision = 512
+
+// escape escapes a key for a JSON pointer.
+func escape(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
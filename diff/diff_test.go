@@ -0,0 +1,54 @@
+package diff
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		changes string
+	}{
+		{"identical", `{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1}`, `[]`},
+		{"equal numbers", `{"a":1}`, `{"a":1.0}`, `[]`},
+		{"changed value", `{"a":1}`, `{"a":2}`,
+			`[{"path":"/a","kind":"changed","old":1,"new":2}]`},
+		{"added and removed keys", `{"a":1,"c":true}`, `{"b":"x","c":true}`,
+			`[{"path":"/a","kind":"removed","old":1},{"path":"/b","kind":"added","new":"x"}]`},
+		{"array elements", `[1,{"x":1}]`, `[1,{"x":2},3]`,
+			`[{"path":"/1/x","kind":"changed","old":1,"new":2},{"path":"/2","kind":"added","new":3}]`},
+		{"changed type", `{"a":[1]}`, `{"a":{"0":1}}`,
+			`[{"path":"/a","kind":"changed","old":[1],"new":{"0":1}}]`},
+		{"escaped keys", `{"a/b":1,"c~d":1}`, `{"a/b":2,"c~d":2}`,
+			`[{"path":"/a~1b","kind":"changed","old":1,"new":2},{"path":"/c~0d","kind":"changed","old":1,"new":2}]`},
+		{"large numbers", `{"a":12345678901234567890}`, `{"a":12345678901234567891}`,
+			`[{"path":"/a","kind":"changed","old":12345678901234567890,"new":12345678901234567891}]`},
+		{"no JSON", `plain text`, `other text`,
+			`[{"path":"","kind":"changed","old":"plain text","new":"other text"}]`},
+	}
+
+	for _, test := range tests {
+		changes, err := json.Marshal(JSON([]byte(test.a), []byte(test.b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(changes) != test.changes {
+			t.Errorf("%s: got %s, want %s", test.name, changes, test.changes)
+		}
+	}
+}
+
+func TestPattern(t *testing.T) {
+	changes := JSON([]byte(`{"a":[{"b":1},{"b":1}]}`), []byte(`{"a":[{"b":2},{"b":3}]}`))
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes, want 2", len(changes))
+	}
+
+	for _, c := range changes {
+		if c.Pattern() != "/a/*/b" {
+			t.Errorf("%s: got pattern %s, want /a/*/b", c.Path, c.Pattern())
+		}
+	}
+}
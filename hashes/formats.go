@@ -0,0 +1,200 @@
+package hashes
+
+import (
+	"bytes"
+	"crypto/md5"
+	"debug/elf"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Formats are the digests of the structure of executables, they stay the
+// same for many builds of a malware family.
+type Formats struct {
+	// Imphash is the md5 of the imports of a PE file as computed by
+	// pefile, SectionHashes the md5 of every PE section as "name:md5".
+	Imphash       string
+	SectionHashes []string
+
+	// ELFImportHash is the md5 of the sorted names of the symbols an ELF
+	// file imports.
+	ELFImportHash string
+}
+
+// FormatDigests returns the digests of PE and ELF files, they are empty
+// for other files and for executables which can't be parsed.
+func FormatDigests(data []byte) *Formats {
+	f := &Formats{}
+
+	if p, err := pe.NewFile(bytes.NewReader(data)); err == nil {
+		defer p.Close()
+
+		if imports, err := peImports(p); err == nil && len(imports) > 0 {
+			f.Imphash = fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(imports, ","))))
+		}
+		for _, section := range p.Sections {
+			if data, err := section.Data(); err == nil {
+				f.SectionHashes = append(f.SectionHashes, section.Name+":"+fmt.Sprintf("%x", md5.Sum(data)))
+			}
+		}
+
+		return f
+	}
+
+	if e, err := elf.NewFile(bytes.NewReader(data)); err == nil {
+		defer e.Close()
+
+		if symbols, err := e.ImportedSymbols(); err == nil && len(symbols) > 0 {
+			names := make([]string, len(symbols))
+			for i, symbol := range symbols {
+				names[i] = strings.ToLower(symbol.Name)
+			}
+			sort.Strings(names)
+			f.ELFImportHash = fmt.Sprintf("%x", md5.Sum([]byte(strings.Join(names, ","))))
+		}
+	}
+
+	return f
+}
+
+const peImportDirectory = 1
+
+// peImports returns the imports of a PE file as "library.function" in the
+// form pefile uses for the imphash: lower case, without the extension of
+// the library and with functions imported by ordinal named "ord<n>".
+// debug/pe skips the latter, so the import directory is read here.
+func peImports(p *pe.File) ([]string, error) {
+	var dir pe.DataDirectory
+	thunkSize := uint32(4)
+	switch h := p.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		if h.NumberOfRvaAndSizes < 2 {
+			return nil, nil
+		}
+		dir = h.DataDirectory[peImportDirectory]
+	case *pe.OptionalHeader64:
+		if h.NumberOfRvaAndSizes < 2 {
+			return nil, nil
+		}
+		dir = h.DataDirectory[peImportDirectory]
+		thunkSize = 8
+	default:
+		return nil, nil
+	}
+	if dir.VirtualAddress == 0 {
+		return nil, nil
+	}
+
+	// read returns the data at a virtual address, every section is only
+	// read once
+	sections := make(map[*pe.Section][]byte)
+	read := func(rva uint32) []byte {
+		for _, s := range p.Sections {
+			size := s.VirtualSize
+			if s.Size > size {
+				size = s.Size
+			}
+			if rva >= s.VirtualAddress && rva < s.VirtualAddress+size {
+				data, ok := sections[s]
+				if !ok {
+					data, _ = s.Data()
+					sections[s] = data
+				}
+				if rva-s.VirtualAddress >= uint32(len(data)) {
+					return nil
+				}
+				return data[rva-s.VirtualAddress:]
+			}
+		}
+		return nil
+	}
+	str := func(rva uint32) string {
+		b := read(rva)
+		if i := bytes.IndexByte(b, 0); i != -1 {
+			b = b[:i]
+		}
+		return string(b)
+	}
+
+	var imports []string
+	for descriptor := read(dir.VirtualAddress); len(descriptor) >= 20; descriptor = descriptor[20:] {
+		lookup := binary.LittleEndian.Uint32(descriptor[0:4])
+		name := binary.LittleEndian.Uint32(descriptor[12:16])
+		first := binary.LittleEndian.Uint32(descriptor[16:20])
+		if name == 0 && first == 0 {
+			break
+		}
+		if lookup == 0 {
+			lookup = first
+		}
+
+		dll := strings.ToLower(str(name))
+		library := dll
+		if i := strings.LastIndex(library, "."); i != -1 {
+			switch library[i+1:] {
+			case "dll", "ocx", "sys":
+				library = library[:i]
+			}
+		}
+
+		thunks := read(lookup)
+		if thunks == nil {
+			return nil, errors.New("Invalid import table of " + dll)
+		}
+		for ; uint32(len(thunks)) >= thunkSize; thunks = thunks[thunkSize:] {
+			var thunk uint64
+			var byOrdinal bool
+			if thunkSize == 8 {
+				thunk = binary.LittleEndian.Uint64(thunks)
+				byOrdinal = thunk&(1<<63) != 0
+			} else {
+				thunk = uint64(binary.LittleEndian.Uint32(thunks))
+				byOrdinal = thunk&(1<<31) != 0
+			}
+			if thunk == 0 {
+				break
+			}
+
+			var function string
+			if byOrdinal {
+				function = ordinalName(dll, uint16(thunk))
+			} else {
+				// skip the hint in front of the name
+				function = str(uint32(thunk) + 2)
+			}
+			imports = append(imports, library+"."+strings.ToLower(function))
+		}
+	}
+
+	return imports, nil
+}
+
+// winsockOrdinals names the functions of the winsock libraries, which are
+// commonly imported by ordinal.
+var winsockOrdinals = map[uint16]string{
+	1: "accept", 2: "bind", 3: "closesocket", 4: "connect", 5: "getpeername",
+	6: "getsockname", 7: "getsockopt", 8: "htonl", 9: "htons", 10: "ioctlsocket",
+	11: "inet_addr", 12: "inet_ntoa", 13: "listen", 14: "ntohl", 15: "ntohs",
+	16: "recv", 17: "recvfrom", 18: "select", 19: "send", 20: "sendto",
+	21: "setsockopt", 22: "shutdown", 23: "socket",
+	51: "gethostbyaddr", 52: "gethostbyname", 53: "getprotobyname",
+	54: "getprotobynumber", 55: "getservbyname", 56: "getservbyport", 57: "gethostname",
+	111: "WSAGetLastError", 112: "WSASetLastError", 115: "WSAStartup", 116: "WSACleanup",
+	151: "__WSAFDIsSet",
+}
+
+// ordinalName names a function imported by ordinal like pefile does.
+func ordinalName(dll string, ordinal uint16) string {
+	if dll == "ws2_32.dll" || dll == "wsock32.dll" {
+		if name, ok := winsockOrdinals[ordinal]; ok {
+			return name
+		}
+	}
+
+	return "ord" + strconv.Itoa(int(ordinal))
+}
@@ -0,0 +1,113 @@
+package hashes
+
+import (
+	"bytes"
+	"crypto/md5"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// peFile builds an executable whose .idata section imports ExitProcess
+// and GetProcAddress from kernel32.dll and WSAStartup and the unnamed
+// ordinal 500 from ws2_32.dll.
+func peFile(is64 bool) []byte {
+	const (
+		va     = 0x1000
+		offset = 0x200
+	)
+
+	// the import directory and everything it refers to
+	idata := make([]byte, 0x200)
+	le := binary.LittleEndian
+	descriptor := func(at, lookup, name uint32) {
+		le.PutUint32(idata[at:], lookup)
+		le.PutUint32(idata[at+12:], name)
+		le.PutUint32(idata[at+16:], lookup)
+	}
+	descriptor(0, va+0x40, va+0xc0)
+	descriptor(20, va+0x60, va+0xd0)
+
+	thunk := func(at uint32, value uint64, ordinal bool) {
+		if is64 {
+			if ordinal {
+				value |= 1 << 63
+			}
+			le.PutUint64(idata[at:], value)
+		} else {
+			if ordinal {
+				value |= 1 << 31
+			}
+			le.PutUint32(idata[at:], uint32(value))
+		}
+	}
+	size := uint32(4)
+	if is64 {
+		size = 8
+	}
+	thunk(0x40, va+0x80, false)
+	thunk(0x40+size, va+0xa0, false)
+	thunk(0x60, 115, true)
+	thunk(0x60+size, 500, true)
+
+	copy(idata[0x82:], "ExitProcess")
+	copy(idata[0xa2:], "GetProcAddress")
+	copy(idata[0xc0:], "KERNEL32.dll")
+	copy(idata[0xd0:], "WS2_32.dll")
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("MZ")
+	buf.Write(make([]byte, 0x3a))
+	binary.Write(buf, le, uint32(0x40))
+	buf.WriteString("PE\x00\x00")
+
+	directories := [16]pe.DataDirectory{}
+	directories[peImportDirectory] = pe.DataDirectory{VirtualAddress: va, Size: 60}
+	if is64 {
+		binary.Write(buf, le, &pe.FileHeader{Machine: pe.IMAGE_FILE_MACHINE_AMD64, NumberOfSections: 1, SizeOfOptionalHeader: 240})
+		binary.Write(buf, le, &pe.OptionalHeader64{Magic: 0x20b, NumberOfRvaAndSizes: 16, DataDirectory: directories})
+	} else {
+		binary.Write(buf, le, &pe.FileHeader{Machine: pe.IMAGE_FILE_MACHINE_I386, NumberOfSections: 1, SizeOfOptionalHeader: 224})
+		binary.Write(buf, le, &pe.OptionalHeader32{Magic: 0x10b, NumberOfRvaAndSizes: 16, DataDirectory: directories})
+	}
+
+	section := &pe.SectionHeader32{VirtualSize: 0x200, VirtualAddress: va, SizeOfRawData: 0x200, PointerToRawData: offset}
+	copy(section.Name[:], ".idata")
+	binary.Write(buf, le, section)
+
+	buf.Write(make([]byte, offset-buf.Len()))
+	buf.Write(idata)
+
+	return buf.Bytes()
+}
+
+func TestFormatDigests(t *testing.T) {
+	// md5 of "kernel32.exitprocess,kernel32.getprocaddress,ws2_32.wsastartup,ws2_32.ord500"
+	const imphash = "f843fc5e690166b62413d6de58dd4dc6"
+
+	tests := []struct {
+		name    string
+		data    []byte
+		imphash string
+	}{
+		{"PE32", peFile(false), imphash},
+		{"PE32+", peFile(true), imphash},
+		{"no executable", []byte("MZ, but not really"), ""},
+	}
+
+	for _, test := range tests {
+		f := FormatDigests(test.data)
+		if f.Imphash != test.imphash {
+			t.Errorf("%s: imphash %q, want %q", test.name, f.Imphash, test.imphash)
+		}
+		if test.imphash == "" {
+			continue
+		}
+
+		section := fmt.Sprintf(".idata:%x", md5.Sum(test.data[0x200:]))
+		if len(f.SectionHashes) != 1 || f.SectionHashes[0] != section {
+			t.Errorf("%s: section hashes %v, want [%s]", test.name, f.SectionHashes, section)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package hashes
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	ssdeepWindow       = 7
+	ssdeepMinBlockSize = 3
+	ssdeepLength       = 64
+	ssdeepHashPrime    = 0x01000193
+	ssdeepHashInit     = 0x28021967
+	ssdeepAlphabet     = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+)
+
+// ssdeepRoll is the rolling hash over the last ssdeepWindow bytes which
+// triggers the end of a piece.
+type ssdeepRoll struct {
+	window     [ssdeepWindow]uint32
+	h1, h2, h3 uint32
+	n          int
+}
+
+func (r *ssdeepRoll) update(c byte) {
+	r.h2 -= r.h1
+	r.h2 += ssdeepWindow * uint32(c)
+
+	r.h1 += uint32(c)
+	r.h1 -= r.window[r.n%ssdeepWindow]
+
+	r.window[r.n%ssdeepWindow] = uint32(c)
+	r.n++
+
+	r.h3 <<= 5
+	r.h3 ^= uint32(c)
+}
+
+func (r *ssdeepRoll) sum() uint32 {
+	return r.h1 + r.h2 + r.h3
+}
+
+// SSDeep returns the context triggered piecewise hash (spamsum) of data,
+// compatible with the ssdeep tool. It has the form
+// "blocksize:digest:digest2", the second digest is computed with twice the
+// block size, so hashes of neighbouring block sizes can be compared too.
+func SSDeep(data []byte) string {
+	blockSize := uint32(ssdeepMinBlockSize)
+	for blockSize*ssdeepLength < uint32(len(data)) {
+		blockSize *= 2
+	}
+
+	for {
+		digest, digest2, pieces := ssdeepDigest(data, blockSize)
+
+		// too few pieces make a poor hash, retry with smaller pieces
+		if blockSize > ssdeepMinBlockSize && pieces < ssdeepLength/2 {
+			blockSize /= 2
+			continue
+		}
+
+		return strconv.FormatUint(uint64(blockSize), 10) + ":" + digest + ":" + digest2
+	}
+}
+
+// ssdeepDigest returns both digests for a block size and the number of
+// pieces the first one ended.
+func ssdeepDigest(data []byte, blockSize uint32) (string, string, int) {
+	var roll ssdeepRoll
+	h, h2 := uint32(ssdeepHashInit), uint32(ssdeepHashInit)
+	digest := make([]byte, 0, ssdeepLength)
+	digest2 := make([]byte, 0, ssdeepLength/2)
+
+	// the last character is kept updating once a digest is full
+	var last, last2 byte
+
+	for _, c := range data {
+		h = h*ssdeepHashPrime ^ uint32(c)
+		h2 = h2*ssdeepHashPrime ^ uint32(c)
+		roll.update(c)
+		sum := roll.sum()
+
+		if sum%blockSize == blockSize-1 {
+			if len(digest) < ssdeepLength-1 {
+				digest = append(digest, ssdeepAlphabet[h%64])
+				h = ssdeepHashInit
+			} else {
+				last = ssdeepAlphabet[h%64]
+			}
+		}
+		if sum%(blockSize*2) == blockSize*2-1 {
+			if len(digest2) < ssdeepLength/2-1 {
+				digest2 = append(digest2, ssdeepAlphabet[h2%64])
+				h2 = ssdeepHashInit
+			} else {
+				last2 = ssdeepAlphabet[h2%64]
+			}
+		}
+	}
+
+	pieces := len(digest)
+	if roll.sum() != 0 {
+		digest = append(digest, ssdeepAlphabet[h%64])
+		digest2 = append(digest2, ssdeepAlphabet[h2%64])
+	} else {
+		if last != 0 {
+			digest = append(digest, last)
+		}
+		if last2 != 0 {
+			digest2 = append(digest2, last2)
+		}
+	}
+
+	return string(digest), string(digest2), pieces
+}
+
+// parseSSDeep splits a hash into its block size and digests.
+func parseSSDeep(hash string) (uint32, string, string, error) {
+	parts := strings.SplitN(hash, ":", 3)
+	if len(parts) != 3 {
+		return 0, "", "", errors.New("Invalid ssdeep hash: " + hash)
+	}
+
+	blockSize, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || blockSize < ssdeepMinBlockSize {
+		return 0, "", "", errors.New("Invalid ssdeep block size: " + parts[0])
+	}
+
+	return uint32(blockSize), parts[1], parts[2], nil
+}
+
+// SSDeepBucket returns the block size of a hash, only hashes of the same
+// or neighbouring block sizes can be similar.
+func SSDeepBucket(hash string) (string, error) {
+	blockSize, _, _, err := parseSSDeep(hash)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatUint(uint64(blockSize), 10), nil
+}
+
+// SSDeepBuckets returns the buckets of the hashes which can be similar to
+// the hash.
+func SSDeepBuckets(hash string) ([]string, error) {
+	blockSize, _, _, err := parseSSDeep(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := []string{strconv.FormatUint(uint64(blockSize), 10), strconv.FormatUint(uint64(blockSize)*2, 10)}
+	if blockSize/2 >= ssdeepMinBlockSize {
+		buckets = append(buckets, strconv.FormatUint(uint64(blockSize/2), 10))
+	}
+
+	return buckets, nil
+}
+
+// SSDeepCompare returns the similarity of two hashes from 0 (unrelated) to
+// 100 (identical), like "ssdeep -d" does.
+func SSDeepCompare(a, b string) (int, error) {
+	blockSize1, a1, a2, err := parseSSDeep(a)
+	if err != nil {
+		return 0, err
+	}
+	blockSize2, b1, b2, err := parseSSDeep(b)
+	if err != nil {
+		return 0, err
+	}
+
+	if blockSize1 != blockSize2 && blockSize1 != blockSize2*2 && blockSize2 != blockSize1*2 {
+		return 0, nil
+	}
+	if blockSize1 == blockSize2 && a1 == b1 && a2 == b2 {
+		return 100, nil
+	}
+
+	// long runs of the same character carry little information
+	a1, a2 = ssdeepEliminateRuns(a1), ssdeepEliminateRuns(a2)
+	b1, b2 = ssdeepEliminateRuns(b1), ssdeepEliminateRuns(b2)
+
+	switch {
+	case blockSize1 == blockSize2:
+		score1 := ssdeepScore(a1, b1, blockSize1)
+		score2 := ssdeepScore(a2, b2, blockSize1*2)
+		if score2 > score1 {
+			return score2, nil
+		}
+		return score1, nil
+	case blockSize1 == blockSize2*2:
+		return ssdeepScore(a1, b2, blockSize1), nil
+	}
+
+	return ssdeepScore(a2, b1, blockSize2), nil
+}
+
+// ssdeepEliminateRuns shortens runs of more than three equal characters.
+func ssdeepEliminateRuns(s string) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if i < 3 || s[i] != s[i-1] || s[i] != s[i-2] || s[i] != s[i-3] {
+			out = append(out, s[i])
+		}
+	}
+
+	return string(out)
+}
+
+// ssdeepScore compares two digests of the same block size.
+func ssdeepScore(a, b string, blockSize uint32) int {
+	if len(a) > ssdeepLength || len(b) > ssdeepLength {
+		return 0
+	}
+	if !ssdeepCommonSubstring(a, b) {
+		return 0
+	}
+
+	score := ssdeepEditDistance(a, b)
+	score = score * ssdeepLength / (len(a) + len(b))
+	score = 100 * score / ssdeepLength
+	if score >= 100 {
+		return 0
+	}
+	score = 100 - score
+
+	// small block sizes would overstate the similarity of short inputs
+	if blockSize >= (99+ssdeepWindow)/ssdeepWindow*ssdeepMinBlockSize {
+		return score
+	}
+
+	shorter := len(a)
+	if len(b) < shorter {
+		shorter = len(b)
+	}
+	if max := int(blockSize) / ssdeepMinBlockSize * shorter; score > max {
+		score = max
+	}
+
+	return score
+}
+
+// ssdeepCommonSubstring reports whether the digests share a substring of
+// ssdeepWindow characters.
+func ssdeepCommonSubstring(a, b string) bool {
+	if len(a) < ssdeepWindow || len(b) < ssdeepWindow {
+		return false
+	}
+
+	seen := make(map[string]bool, len(a))
+	for i := 0; i+ssdeepWindow <= len(a); i++ {
+		seen[a[i:i+ssdeepWindow]] = true
+	}
+	for i := 0; i+ssdeepWindow <= len(b); i++ {
+		if seen[b[i:i+ssdeepWindow]] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ssdeepEditDistance is the Levenshtein distance where a substitution
+// costs as much as a deletion and an insertion.
+func ssdeepEditDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := prev[j-1]
+			if a[i-1] != b[j-1] {
+				cost += 2
+			}
+			if prev[j]+1 < cost {
+				cost = prev[j] + 1
+			}
+			if cur[j-1]+1 < cost {
+				cost = cur[j-1] + 1
+			}
+			cur[j] = cost
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
@@ -0,0 +1,55 @@
+package hashes
+
+import "testing"
+
+// the hashes and the score are the ones the ssdeep tool gives
+var (
+	ssdeepLower = []byte("Also called fuzzy hashes, Ctph can match inputs that have homologies.")
+	ssdeepUpper = []byte("Also called fuzzy hashes, CTPH can match inputs that have homologies.")
+)
+
+func TestSSDeep(t *testing.T) {
+	tests := []struct {
+		data []byte
+		hash string
+	}{
+		{nil, "3::"},
+		{ssdeepLower, "3:AXGBicFlgVNhBGcL6wCrFQEv:AXGHsNhxLsr2C"},
+		{ssdeepUpper, "3:AXGBicFlIHBGcL6wCrFQEv:AXGH6xLsr2C"},
+	}
+
+	for _, test := range tests {
+		if hash := SSDeep(test.data); hash != test.hash {
+			t.Errorf("%q: got %q, want %q", test.data, hash, test.hash)
+		}
+	}
+}
+
+func TestSSDeepCompare(t *testing.T) {
+	lower, upper := SSDeep(ssdeepLower), SSDeep(ssdeepUpper)
+
+	tests := []struct {
+		a, b  string
+		score int
+	}{
+		{lower, lower, 100},
+		{lower, upper, 22},
+		{lower, "3::", 0},
+		// only neighbouring block sizes are compared
+		{"3:AXGBicFlgVNhBGcL6wCrFQEv:AXGHsNhxLsr2C", "12:AXGBicFlgVNhBGcL6wCrFQEv:AXGHsNhxLsr2C", 0},
+	}
+
+	for _, test := range tests {
+		score, err := SSDeepCompare(test.a, test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if score != test.score {
+			t.Errorf("%s and %s: got %d, want %d", test.a, test.b, score, test.score)
+		}
+	}
+
+	if _, err := SSDeepCompare(lower, "3"); err == nil {
+		t.Error("an invalid hash was accepted")
+	}
+}
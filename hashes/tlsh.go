@@ -0,0 +1,278 @@
+package hashes
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	tlshMinLength = 50
+	tlshBuckets   = 128
+	tlshCodeSize  = tlshBuckets / 4
+	tlshHexLength = 2 * (3 + tlshCodeSize)
+)
+
+// tlshPearson is the permutation used by TLSH to map byte triplets to
+// buckets.
+var tlshPearson = [256]byte{
+	1, 87, 49, 12, 176, 178, 102, 166, 121, 193, 6, 84, 249, 230, 44, 163,
+	14, 197, 213, 181, 161, 85, 218, 80, 64, 239, 24, 226, 236, 142, 38, 200,
+	110, 177, 104, 103, 141, 253, 255, 50, 77, 101, 81, 18, 45, 96, 31, 222,
+	25, 107, 190, 70, 86, 237, 240, 34, 72, 242, 20, 214, 244, 227, 149, 235,
+	97, 234, 57, 22, 60, 250, 82, 175, 208, 5, 127, 199, 111, 62, 135, 248,
+	174, 169, 211, 58, 66, 154, 106, 195, 245, 171, 17, 187, 182, 179, 0, 243,
+	132, 56, 148, 75, 128, 133, 158, 100, 130, 126, 91, 13, 153, 246, 216, 219,
+	119, 68, 223, 78, 83, 88, 201, 99, 122, 11, 92, 32, 136, 114, 52, 10,
+	138, 30, 48, 183, 156, 35, 61, 26, 143, 74, 251, 94, 129, 162, 63, 152,
+	170, 7, 115, 167, 241, 206, 3, 150, 55, 59, 151, 220, 90, 53, 23, 131,
+	125, 173, 15, 238, 79, 95, 89, 16, 105, 137, 225, 224, 217, 160, 37, 123,
+	118, 73, 2, 157, 46, 116, 9, 145, 134, 228, 207, 212, 202, 215, 69, 229,
+	27, 188, 67, 124, 168, 252, 42, 4, 29, 108, 21, 247, 19, 205, 39, 203,
+	233, 40, 186, 147, 198, 192, 155, 33, 164, 191, 98, 204, 165, 180, 117, 76,
+	140, 36, 210, 172, 41, 54, 159, 8, 185, 232, 113, 196, 231, 47, 146, 120,
+	51, 65, 28, 144, 254, 221, 93, 189, 194, 139, 112, 43, 71, 109, 184, 209,
+}
+
+func tlshMap(salt, a, b, c byte) byte {
+	h := tlshPearson[salt]
+	h = tlshPearson[h^a]
+	h = tlshPearson[h^b]
+	return tlshPearson[h^c]
+}
+
+// tlsh is a decoded TLSH hash.
+type tlsh struct {
+	checksum byte
+	length   byte
+	q1, q2   byte
+	code     [tlshCodeSize]byte
+}
+
+// TLSH returns the TLSH hash of data in the "T1" format of TLSH 4, or an
+// empty string if data is shorter than 50 bytes or too uniform to be
+// hashed.
+func TLSH(data []byte) string {
+	if len(data) < tlshMinLength || int64(len(data)) > math.MaxUint32 {
+		return ""
+	}
+
+	var buckets [256]uint32
+	var checksum byte
+
+	// every window of five bytes adds six triplets to the buckets
+	for i := 4; i < len(data); i++ {
+		a, b, c, d, e := data[i], data[i-1], data[i-2], data[i-3], data[i-4]
+
+		checksum = tlshMap(0, a, b, checksum)
+
+		buckets[tlshMap(2, a, b, c)]++
+		buckets[tlshMap(3, a, b, d)]++
+		buckets[tlshMap(5, a, c, d)]++
+		buckets[tlshMap(7, a, c, e)]++
+		buckets[tlshMap(11, a, b, e)]++
+		buckets[tlshMap(13, a, d, e)]++
+	}
+
+	sorted := make([]int, tlshBuckets)
+	nonzero := 0
+	for i := 0; i < tlshBuckets; i++ {
+		sorted[i] = int(buckets[i])
+		if buckets[i] > 0 {
+			nonzero++
+		}
+	}
+	if nonzero <= tlshBuckets/2 {
+		return ""
+	}
+
+	sort.Ints(sorted)
+	q1 := uint32(sorted[tlshBuckets/4-1])
+	q2 := uint32(sorted[tlshBuckets/2-1])
+	q3 := uint32(sorted[tlshBuckets*3/4-1])
+	if q3 == 0 {
+		return ""
+	}
+
+	t := &tlsh{
+		checksum: checksum,
+		length:   tlshLength(len(data)),
+		q1:       byte(uint32(float32(q1*100)/float32(q3)) % 16),
+		q2:       byte(uint32(float32(q2*100)/float32(q3)) % 16),
+	}
+
+	for i := 0; i < tlshCodeSize; i++ {
+		var h byte
+		for j := uint(0); j < 4; j++ {
+			k := buckets[4*i+int(j)]
+			switch {
+			case q3 < k:
+				h += 3 << (j * 2)
+			case q2 < k:
+				h += 2 << (j * 2)
+			case q1 < k:
+				h += 1 << (j * 2)
+			}
+		}
+		t.code[i] = h
+	}
+
+	return t.String()
+}
+
+// tlshLength captures the data length on a logarithmic scale.
+func tlshLength(n int) byte {
+	l := math.Log(float64(float32(n)))
+
+	var i int
+	switch {
+	case n <= 656:
+		i = int(math.Floor(l / 0.4054651))
+	case n <= 3199:
+		i = int(math.Floor(l/0.26236426 - 8.72777))
+	default:
+		i = int(math.Floor(l/0.095310180 - 62.5472))
+	}
+
+	return byte(i & 0xff)
+}
+
+func swapNibbles(b byte) byte {
+	return b<<4 | b>>4
+}
+
+func (t *tlsh) String() string {
+	raw := make([]byte, 0, 3+tlshCodeSize)
+	raw = append(raw, swapNibbles(t.checksum), swapNibbles(t.length), t.q1<<4|t.q2)
+	for i := tlshCodeSize - 1; i >= 0; i-- {
+		raw = append(raw, t.code[i])
+	}
+
+	return "T1" + strings.ToUpper(hex.EncodeToString(raw))
+}
+
+func parseTLSH(hash string) (*tlsh, error) {
+	h := strings.TrimPrefix(strings.ToUpper(hash), "T1")
+	if len(h) != tlshHexLength {
+		return nil, errors.New("Invalid TLSH hash: " + hash)
+	}
+
+	raw, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, errors.New("Invalid TLSH hash: " + hash)
+	}
+
+	t := &tlsh{
+		checksum: swapNibbles(raw[0]),
+		length:   swapNibbles(raw[1]),
+		q1:       raw[2] >> 4,
+		q2:       raw[2] & 0xf,
+	}
+	for i := 0; i < tlshCodeSize; i++ {
+		t.code[i] = raw[len(raw)-1-i]
+	}
+
+	return t, nil
+}
+
+// tlshModDiff is the distance of x and y on a circle of size r.
+func tlshModDiff(x, y, r int) int {
+	d := x - y
+	if d < 0 {
+		d = -d
+	}
+	if r-d < d {
+		return r - d
+	}
+
+	return d
+}
+
+// TLSHDistance returns the distance of two hashes including their length,
+// 0 means (almost) identical. Distances below 100 usually indicate
+// related files, below 30 very similar ones.
+func TLSHDistance(a, b string) (int, error) {
+	x, err := parseTLSH(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := parseTLSH(b)
+	if err != nil {
+		return 0, err
+	}
+
+	diff := tlshModDiff(int(x.length), int(y.length), 256)
+	if diff > 1 {
+		diff *= 12
+	}
+
+	for _, q := range [][2]byte{{x.q1, y.q1}, {x.q2, y.q2}} {
+		d := tlshModDiff(int(q[0]), int(q[1]), 16)
+		if d <= 1 {
+			diff += d
+		} else {
+			diff += (d - 1) * 12
+		}
+	}
+
+	if x.checksum != y.checksum {
+		diff++
+	}
+
+	for i := range x.code {
+		for j := uint(0); j < 8; j += 2 {
+			d := int(x.code[i]>>j&3) - int(y.code[i]>>j&3)
+			if d < 0 {
+				d = -d
+			}
+			if d == 3 {
+				d = 6
+			}
+			diff += d
+		}
+	}
+
+	return diff, nil
+}
+
+// TLSHBucket returns the length part of a hash, hashes of data with very
+// different lengths are always distant.
+func TLSHBucket(hash string) (string, error) {
+	t, err := parseTLSH(hash)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.Itoa(int(t.length)), nil
+}
+
+// TLSHBuckets returns the buckets of the hashes which can be within
+// maxDistance of the hash.
+func TLSHBuckets(hash string, maxDistance int) ([]string, error) {
+	t, err := parseTLSH(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	spread := 1
+	if maxDistance/12 > spread {
+		spread = maxDistance / 12
+	}
+
+	var buckets []string
+	if spread >= 128 {
+		for l := 0; l < 256; l++ {
+			buckets = append(buckets, strconv.Itoa(l))
+		}
+		return buckets, nil
+	}
+
+	for d := -spread; d <= spread; d++ {
+		buckets = append(buckets, strconv.Itoa(int(byte(int(t.length)+d))))
+	}
+
+	return buckets, nil
+}
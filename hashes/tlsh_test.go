@@ -0,0 +1,104 @@
+package hashes
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestTLSH guards against regressions, the digests were produced by this
+// implementation. TestTLSHReference checks the same inputs against the
+// reference tool.
+func TestTLSH(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		hash string
+	}{
+		{"too short", testFile(t, "minimum.bin")[:49], ""},
+		{"too uniform", bytes.Repeat([]byte{'a'}, 1000), ""},
+		{"minimum length", testFile(t, "minimum.bin"), "T1009002052505D5014106EAA908EC718951100296E20C122194101553C5501188780046"},
+		{"random", testFile(t, "random.bin"), "T1D71198D7171DD7C30188165823F51568B7597773DBEC311F40200960EEF0B9780AD169"},
+		{"flipped bit", testFile(t, "flipped.bin"), "T1B01198D7172DD7C30188165823F51568B75D7773DBEC311F40200960EEF0B9780AD169"},
+		{"long", testFile(t, "long.bin"), "T17FA3023CEFE64B851515C3ACA73ED45DC868F836DF2398A81C510899D61DE0A4AE7B88"},
+		{"text", testFile(t, "text.txt"), "T12DC0024A311C1794658A1888438D95B2D2C9C910612114116570604219482359CD8551"},
+	}
+
+	for _, test := range tests {
+		if hash := TLSH(test.data); hash != test.hash {
+			t.Errorf("%s: got %q, want %q", test.name, hash, test.hash)
+		}
+	}
+}
+
+// tlshTestdata holds the inputs of the tests, the digests the reference
+// tool prints for them belong in reference.txt.
+const tlshTestdata = "testdata/tlsh"
+
+func testFile(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join(tlshTestdata, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestTLSHReference compares against the output of the reference tool
+// (github.com/trendmicro/tlsh), generated in the hashes directory with
+//
+//	tlsh -r testdata/tlsh > testdata/tlsh/reference.txt
+func TestTLSHReference(t *testing.T) {
+	reference, err := ioutil.ReadFile(filepath.Join(tlshTestdata, "reference.txt"))
+	if os.IsNotExist(err) {
+		t.Skip("no digests of the reference tool in " + tlshTestdata)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(string(reference), "\n") {
+		// <digest> <path>, files too short or uniform are reported as TNULL
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		digest, name := fields[0], filepath.Base(fields[len(fields)-1])
+		if digest == "TNULL" {
+			digest = ""
+		}
+
+		if hash := TLSH(testFile(t, name)); hash != digest {
+			t.Errorf("%s: got %q, the reference tool printed %q", name, hash, digest)
+		}
+	}
+}
+
+func TestTLSHDistance(t *testing.T) {
+	random := "T1D71198D7171DD7C30188165823F51568B7597773DBEC311F40200960EEF0B9780AD169"
+
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{random, random, 0},
+		{random, "T1B01198D7172DD7C30188165823F51568B75D7773DBEC311F40200960EEF0B9780AD169", 3},
+		{random, "t1d71198d7171dd7c30188165823f51568b7597773dbec311f40200960eef0b9780ad169", 0},
+	}
+
+	for _, test := range tests {
+		distance, err := TLSHDistance(test.a, test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if distance != test.distance {
+			t.Errorf("distance of %s and %s: got %d, want %d", test.a, test.b, distance, test.distance)
+		}
+	}
+
+	if _, err := TLSHDistance(random, "T1D711"); err == nil {
+		t.Error("a truncated hash was accepted")
+	}
+}
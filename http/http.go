@@ -1,22 +1,31 @@
 package http
 
 import (
+	"bytes"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/HolmesProcessing/Holmes-Storage/archive"
 	"github.com/HolmesProcessing/Holmes-Storage/context"
 	"github.com/HolmesProcessing/Holmes-Storage/dataStorage"
+	"github.com/HolmesProcessing/Holmes-Storage/diff"
+	"github.com/HolmesProcessing/Holmes-Storage/hashes"
+	"github.com/HolmesProcessing/Holmes-Storage/ingest"
 	"github.com/HolmesProcessing/Holmes-Storage/objectStorage"
 
 	"github.com/julienschmidt/httprouter"
@@ -43,17 +52,28 @@ func Start(c *context.Ctx) {
 	//... for data
 	router.GET("/api/v2/objects", objectGet) //get a list of recent objects or search
 	router.GET("/api/v2/objects/:sha256", objectGet) //get a specific object
-	router.POST("/api/v2/objects/", dummyHandler) //create a new object
+	router.POST("/api/v2/objects/", objectStore) //create a new object
 	router.PUT("/api/v2/objects", dummyHandler) //return 405 error
 	router.PUT("/api/v2/objects/:sha256", dummyHandler) //updates specific object
 	router.DELETE("/api/v2/objects/:sha256", dummyHandler) //delete specific object
+	router.PATCH("/api/v2/objects/:sha256", objectUpdate) //recompute the submission fields of a specific object
+	router.POST("/api/v2/objects/:sha256/data", genericDataStore) //attach a payload to a generic object
+	router.POST("/api/v2/objects/:sha256/tags", tagsAdd("object", "sha256")) //tag a specific object
+	router.DELETE("/api/v2/objects/:sha256/tags/:tag", tagsRemove("object", "sha256")) //untag a specific object
+	router.GET("/api/v2/objects/:sha256/relations", relationsGet) //get the objects related to a specific object
+	router.POST("/api/v2/objects/:sha256/relations", relationStore) //relate a specific object to another one
+	router.GET("/api/v2/objects/:sha256/results/latest", resultsLatest) //get the current result of every service for a specific object
 
 	router.GET("/api/v2/results", dummyHandler) //get a list of recent results or search
 	router.GET("/api/v2/results/:uuid", dummyHandler) //get a specific result
-	router.POST("/api/v2/results/", dummyHandler) //create a new result
+	router.POST("/api/v2/results/", resultStore) //create a new result
 	router.PUT("/api/v2/results", dummyHandler) //return 405 error
 	router.PUT("/api/v2/results/:uuid", dummyHandler) //updates specific result
 	router.DELETE("/api/v2/results/:uuid", dummyHandler) //delete a specific result
+	router.POST("/api/v2/results/:uuid/tags", tagsAdd("result", "uuid")) //tag a specific result
+	router.DELETE("/api/v2/results/:uuid/tags/:tag", tagsRemove("result", "uuid")) //untag a specific result
+	router.GET("/api/v2/diff/results", resultDiffGet) //compare the output of two results
+	router.POST("/api/v2/diff/results", resultDiffBatch) //summarize the changes between two service versions over many objects
 
 	router.GET("/api/v2/submissions", dummyHandler) //get a list of recent submissions or search
 	router.GET("/api/v2/submissions/:uuid", submissionGet) //get a specific submissions
@@ -61,6 +81,10 @@ func Start(c *context.Ctx) {
 	router.PUT("/api/v2/submissions", dummyHandler) //return 405 error
 	router.PUT("/api/v2/submissions/:uuid", dummyHandler) //updates specific submissions
 	router.DELETE("/api/v2/submissions/:uuid", dummyHandler) //delete a specific submissions
+	router.POST("/api/v2/submissions/:uuid/tags", tagsAdd("submission", "uuid")) //tag a specific submission
+	router.DELETE("/api/v2/submissions/:uuid/tags/:tag", tagsRemove("submission", "uuid")) //untag a specific submission
+
+	router.GET("/api/v2/tags/:tag", tagSearch) //get the objects, submissions or results with a tag
 
 	//we don't have configs implemented yet. So I am just going to leave this here
 	//for future reference. 
@@ -73,9 +97,18 @@ func Start(c *context.Ctx) {
 	//... for raw_data
 	router.GET("/api/v2/raw_data", sampleGet) //return 405 error
 	router.GET("/api/v2/raw_data/:sha256", sampleGet) //get a specific raw data
+	router.HEAD("/api/v2/raw_data/:sha256", sampleStat) //check if a specific raw data exists
 	router.POST("/api/v2/raw_data/", sampleStore) //create a new raw_data entry
 	router.PUT("/api/v2/raw_data", dummyHandler) //return 405 error
 	router.DELETE("/api/v2/raw_data/:sha256", dummyHandler)
+	router.POST("/api/v2/export/raw_data", sampleExport) //stream many raw data entries in one archive
+	router.GET("/api/v2/similar", similarGet) //find objects similar to a known object or fuzzy hash
+	router.POST("/api/v2/similar", similarGet) //find objects similar to an uploaded sample
+
+	//... for administration
+	router.GET("/api/v2/admin/ingest", ingestStatus) //get the backpressure state of the ingestion
+	router.GET("/healthz", healthz) //answers as long as the server runs
+	router.GET("/readyz", readyz) //check every dependency, 503 if one of them fails
 
 	// configure the http server
 	if c.Config.SSLCert != "" && c.Config.SSLKey != "" {
@@ -125,7 +158,15 @@ func dummyHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	httpFailure(w, r, errors.New("Method not implemented"))
 }
 
+// objectGet returns an object or, without a sha256, searches objects by
+// one of "md5", "sha512", "imphash", "section_hash" and "elf_import_hash"
+// and/or the "mime" type, up to "limit" (default: 100) objects.
 func objectGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if ps.ByName("sha256") == "" {
+		objectSearch(w, r)
+		return
+	}
+
 	obj, err := ctx.Data.ObjectGet(strings.ToLower(ps.ByName("sha256")))
 
 	if err != nil {
@@ -136,6 +177,125 @@ func objectGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	httpSuccess(w, r, obj)
 }
 
+func objectSearch(w http.ResponseWriter, r *http.Request) {
+	search := &dataStorage.Object{
+		MD5:               strings.ToLower(r.FormValue("md5")),
+		SHA512:            strings.ToLower(r.FormValue("sha512")),
+		FileMime:          r.FormValue("mime"),
+		FileImphash:       strings.ToLower(r.FormValue("imphash")),
+		FileELFImportHash: strings.ToLower(r.FormValue("elf_import_hash")),
+	}
+	if v := r.FormValue("section_hash"); v != "" {
+		search.FileSectionHashes = []string{strings.ToLower(v)}
+	}
+
+	limit, err := formInt(r, "limit", 100)
+	if err != nil || limit <= 0 {
+		httpFailure(w, r, errors.New("Invalid limit: "+r.FormValue("limit")))
+		return
+	}
+
+	objects, err := ctx.Data.ObjectSearch(search, limit)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	httpSuccess(w, r, objects)
+}
+
+// objectUpdate recomputes the sources, file names, submissions and tags of
+// an object from its submissions, e.g. after submissions were deleted.
+func objectUpdate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sha256 := strings.ToLower(ps.ByName("sha256"))
+	if err := ctx.Data.ObjectUpdate(sha256); err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	obj, err := ctx.Data.ObjectGet(sha256)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	httpSuccess(w, r, obj)
+}
+
+// objectStore submits a domain, ip, email or generic object, given by its
+// "type" and "identifier" (and "generic_type" for generic objects). Like
+// samples it requires the "user_id", "source" and "date" of the submission
+// and takes "name" (default: the identifier), "tags" and "comment".
+// Submitting a known object adds the submission to it.
+func objectStore(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+
+	userId := r.FormValue("user_id")
+	if userId == "" ||
+		r.FormValue("source") == "" ||
+		r.FormValue("type") == "" ||
+		r.FormValue("date") == "" {
+
+		errMsg := fmt.Sprintf("user_id: %s, source: %s, type: %s, date: %s", userId, r.FormValue("source"), r.FormValue("type"), r.FormValue("date"))
+		httpFailure(w, r, errors.New("Please supply all necessary values! "+errMsg))
+		return
+	}
+
+	objType := strings.ToLower(r.FormValue("type"))
+	if objType == "file" {
+		httpFailure(w, r, errors.New("Files are submitted through /api/v2/raw_data/"))
+		return
+	}
+
+	object, err := ingest.NewObject(objType, r.FormValue("identifier"), r.FormValue("generic_type"))
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	date, err := time.Parse(time.RFC3339, r.FormValue("date"))
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		name = strings.TrimSpace(r.FormValue("identifier"))
+	}
+
+	submission := &dataStorage.Submission{
+		SHA256:   object.SHA256,
+		UserId:   userId,
+		Source:   r.FormValue("source"),
+		DateTime: date,
+		ObjName:  name,
+		Tags:     r.Form["tags"],
+		Comment:  r.FormValue("comment"),
+	}
+
+	if err = ctx.Data.SubmissionStore(submission); err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	inserted, err := ctx.Data.ObjectStore(object)
+	if err != nil {
+		// Remove all database entries, like sampleStore does
+		ctx.Data.SubmissionDelete(submission)
+		if inserted {
+			ctx.Data.ObjectDelete(object.SHA256)
+		} else {
+			ctx.Data.ObjectUpdate(object.SHA256)
+		}
+
+		httpFailure(w, r, err)
+		return
+	}
+
+	httpSuccess(w, r, object)
+}
+
 func submissionGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	submission, err := ctx.Data.SubmissionGet(strings.ToLower(ps.ByName("uuid")))
 
@@ -147,20 +307,759 @@ func submissionGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	httpSuccess(w, r, submission)
 }
 
+// tagsAdd returns a handler adding the "tags" values to an entity, the id
+// is taken from the parameter param.
+func tagsAdd(entity, param string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		r.ParseForm()
+
+		var tags []string
+		for _, tag := range r.Form["tags"] {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			httpFailure(w, r, errors.New("Please supply at least one tag"))
+			return
+		}
+
+		id := strings.ToLower(ps.ByName(param))
+		if err := ctx.Data.TagsAdd(entity, id, tags); err != nil {
+			httpFailure(w, r, err)
+			return
+		}
+
+		httpSuccess(w, r, id)
+	}
+}
+
+// tagsRemove returns a handler removing the tag in the path from an entity.
+func tagsRemove(entity, param string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id := strings.ToLower(ps.ByName(param))
+		if err := ctx.Data.TagsRemove(entity, id, []string{ps.ByName("tag")}); err != nil {
+			httpFailure(w, r, err)
+			return
+		}
+
+		httpSuccess(w, r, id)
+	}
+}
+
+// tagSearch lists the entities of a "type" (object by default) carrying a
+// tag, newest first. The range can be narrowed with "from" and "to"
+// (RFC3339) and the number of entries with "limit".
+func tagSearch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	entity := r.FormValue("type")
+	if entity == "" {
+		entity = "object"
+	}
+
+	var from, to time.Time
+	var err error
+	if v := r.FormValue("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			httpFailure(w, r, err)
+			return
+		}
+	}
+	if v := r.FormValue("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			httpFailure(w, r, err)
+			return
+		}
+	}
+
+	limit := 100
+	if v := r.FormValue("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			httpFailure(w, r, errors.New("Invalid limit: "+v))
+			return
+		}
+	}
+
+	entries, err := ctx.Data.TagSearch(entity, ps.ByName("tag"), from, to, limit)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	httpSuccess(w, r, entries)
+}
+
+// relationGraph is the part of the relation graph around an object.
+// Objects maps the sha256 of every reached object to its distance.
+type relationGraph struct {
+	SHA256    string                  `json:"sha256"`
+	Depth     int                     `json:"depth"`
+	Objects   map[string]int          `json:"objects"`
+	Relations []*dataStorage.Relation `json:"relations"`
+	Truncated bool                    `json:"truncated"`
+}
+
+const (
+	relationsMaxDepth   = 5
+	relationsMaxObjects = 1000
+)
+
+// relationsGet returns the relations of an object and, up to "depth" hops
+// (default 1, at most 5), the ones of the objects it is related to in
+// either direction. "type" restricts the followed relations, it may be
+// repeated. The traversal stops after 1000 objects and marks the graph as
+// truncated.
+func relationsGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	r.ParseForm()
+
+	depth := 1
+	if v := r.FormValue("depth"); v != "" {
+		var err error
+		if depth, err = strconv.Atoi(v); err != nil || depth < 1 || depth > relationsMaxDepth {
+			httpFailure(w, r, errors.New("Invalid depth: "+v))
+			return
+		}
+	}
+
+	types := make(map[string]bool)
+	for _, t := range r.Form["type"] {
+		types[t] = true
+	}
+
+	graph := &relationGraph{
+		SHA256:    strings.ToLower(ps.ByName("sha256")),
+		Depth:     depth,
+		Objects:   make(map[string]int),
+		Relations: []*dataStorage.Relation{},
+	}
+	graph.Objects[graph.SHA256] = 0
+	added := make(map[string]bool)
+
+	frontier := []string{graph.SHA256}
+	for distance := 1; distance <= depth && len(frontier) > 0; distance++ {
+		var next []string
+		for _, id := range frontier {
+			relations, err := ctx.Data.RelationsGet(id)
+			if err != nil {
+				httpFailure(w, r, err)
+				return
+			}
+
+			for _, relation := range relations {
+				if len(types) > 0 && !types[relation.Type] {
+					continue
+				}
+
+				other := relation.Related
+				if other == id {
+					other = relation.SHA256
+				}
+				if _, seen := graph.Objects[other]; !seen {
+					if len(graph.Objects) >= relationsMaxObjects {
+						graph.Truncated = true
+						continue
+					}
+					graph.Objects[other] = distance
+					next = append(next, other)
+				}
+
+				// relations between two reached objects are found from both
+				key := relation.SHA256 + " " + relation.Type + " " + relation.Related
+				if !added[key] {
+					added[key] = true
+					graph.Relations = append(graph.Relations, relation)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	httpSuccess(w, r, graph)
+}
+
+// relationStore relates an object to the object "related" with a relation
+// of the given "type", read as "<sha256> <type> <related>". The "service"
+// or "user_id" creating it has to be given.
+func relationStore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	relation := &dataStorage.Relation{
+		SHA256:   strings.ToLower(ps.ByName("sha256")),
+		Type:     r.FormValue("type"),
+		Related:  strings.ToLower(r.FormValue("related")),
+		Service:  r.FormValue("service"),
+		UserId:   r.FormValue("user_id"),
+		DateTime: time.Now(),
+	}
+
+	known := false
+	for _, t := range dataStorage.RelationTypes {
+		known = known || t == relation.Type
+	}
+	if !known {
+		httpFailure(w, r, errors.New("Unknown relation type: "+relation.Type))
+		return
+	}
+	if relation.Service == "" && relation.UserId == "" {
+		httpFailure(w, r, errors.New("Please supply the service or user_id creating the relation"))
+		return
+	}
+	if relation.Related == relation.SHA256 {
+		httpFailure(w, r, errors.New("An object can't be related to itself"))
+		return
+	}
+
+	for _, id := range []string{relation.SHA256, relation.Related} {
+		if _, err := ctx.Data.ObjectGet(id); err != nil {
+			httpFailure(w, r, errors.New("Object "+id+": "+err.Error()))
+			return
+		}
+	}
+
+	if err := ctx.Data.RelationStore(relation); err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	httpSuccess(w, r, relation)
+}
+
+// resultsLatest returns the newest result of every service for an object,
+// of every service version if "per_version" is set. "service" restricts
+// the results to some services and can be repeated.
+func resultsLatest(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	perVersion := false
+	if v := r.FormValue("per_version"); v != "" {
+		var err error
+		if perVersion, err = strconv.ParseBool(v); err != nil {
+			httpFailure(w, r, errors.New("Invalid per_version: "+v))
+			return
+		}
+	}
+
+	results, err := ctx.Data.ResultsLatest(strings.ToLower(ps.ByName("sha256")), perVersion)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	if services := r.Form["service"]; len(services) > 0 {
+		filtered := []*dataStorage.Result{}
+		for _, result := range results {
+			for _, service := range services {
+				if result.ServiceName == service {
+					filtered = append(filtered, result)
+					break
+				}
+			}
+		}
+		results = filtered
+	}
+
+	httpSuccess(w, r, results)
+}
+
+// resultStore accepts a totem result in the same format as the AMQP
+// messages and hands it to the ingestion pipeline. The service name is
+// taken from the "service" parameter or the result itself.
+func resultStore(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	result, err := ingest.Accept(ctx, body, r.URL.Query().Get("service"))
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	if result == nil {
+		// buffered until the storage recovers, there is no id yet
+		httpRespond(w, r, http.StatusAccepted, nil)
+		return
+	}
+
+	httpSuccess(w, r, result.Id)
+}
+
+// resultDiff lists the changes in the output of a service from one result
+// to another.
+type resultDiff struct {
+	SHA256      string         `json:"sha256"`
+	ServiceName string         `json:"service_name"`
+	From        string         `json:"from"`
+	FromVersion string         `json:"from_version"`
+	To          string         `json:"to"`
+	ToVersion   string         `json:"to_version"`
+	Changes     []*diff.Change `json:"changes"`
+}
+
+func resultDiffCompute(from, to *dataStorage.Result) (*resultDiff, error) {
+	a, err := ingest.ResultData(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ingest.ResultData(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resultDiff{
+		SHA256:      to.SHA256,
+		ServiceName: to.ServiceName,
+		From:        from.Id,
+		FromVersion: from.ServiceVersion,
+		To:          to.Id,
+		ToVersion:   to.ServiceVersion,
+		Changes:     diff.JSON(a, b),
+	}, nil
+}
+
+// resultVersions returns the latest results of two versions of a service
+// for an object, nil if there is none.
+func resultVersions(sha256, service, fromVersion, toVersion string) (*dataStorage.Result, *dataStorage.Result, error) {
+	results, err := ctx.Data.ResultsLatest(sha256, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var from, to *dataStorage.Result
+	for _, result := range results {
+		if result.ServiceName != service {
+			continue
+		}
+		if result.ServiceVersion == fromVersion {
+			from = result
+		}
+		if result.ServiceVersion == toVersion {
+			to = result
+		}
+	}
+
+	return from, to, nil
+}
+
+// resultDiffGet compares the output of the results "from" and "to" or,
+// given a "sha256" and a "service", of the latest results of the
+// "from_version" and "to_version" of the service for the object.
+func resultDiffGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var from, to *dataStorage.Result
+
+	if r.FormValue("from") != "" || r.FormValue("to") != "" {
+		var err error
+		if from, err = ctx.Data.ResultGet(strings.ToLower(r.FormValue("from"))); err != nil {
+			httpFailure(w, r, errors.New("Result "+r.FormValue("from")+": "+err.Error()))
+			return
+		}
+		if to, err = ctx.Data.ResultGet(strings.ToLower(r.FormValue("to"))); err != nil {
+			httpFailure(w, r, errors.New("Result "+r.FormValue("to")+": "+err.Error()))
+			return
+		}
+	} else {
+		sha256 := strings.ToLower(r.FormValue("sha256"))
+		service := r.FormValue("service")
+		if sha256 == "" || service == "" || r.FormValue("from_version") == "" || r.FormValue("to_version") == "" {
+			httpFailure(w, r, errors.New("Please supply the results from and to or a sha256, service, from_version and to_version"))
+			return
+		}
+
+		var err error
+		from, to, err = resultVersions(sha256, service, r.FormValue("from_version"), r.FormValue("to_version"))
+		if err != nil {
+			httpFailure(w, r, err)
+			return
+		}
+		if from == nil || to == nil {
+			httpFailure(w, r, errors.New("No results of both versions of "+service+" for "+sha256))
+			return
+		}
+	}
+
+	d, err := resultDiffCompute(from, to)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	httpSuccess(w, r, d)
+}
+
+// resultDiffPath counts the objects in which a field changed. Array
+// indices in the path are replaced by "*".
+type resultDiffPath struct {
+	Path    string `json:"path"`
+	Kind    string `json:"kind"`
+	Objects int    `json:"objects"`
+}
+
+// resultDiffSummary sums up the changes between two versions of a service
+// over many objects. Changed maps the sha256 of the objects to their
+// number of changes, Missing lists the objects lacking a result of either
+// version.
+type resultDiffSummary struct {
+	ServiceName string            `json:"service_name"`
+	FromVersion string            `json:"from_version"`
+	ToVersion   string            `json:"to_version"`
+	Compared    int               `json:"compared"`
+	Identical   int               `json:"identical"`
+	Changed     map[string]int    `json:"changed"`
+	Missing     []string          `json:"missing"`
+	Failed      map[string]string `json:"failed"`
+	Paths       []*resultDiffPath `json:"paths"`
+}
+
+// resultDiffBatch compares the latest results of the "from_version" and
+// "to_version" of a "service" for many objects, selected like the samples
+// of an export by "sha256" values and filters. It returns how many objects
+// changed and which fields changed in how many of them, most often changed
+// first.
+func resultDiffBatch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+
+	service := r.FormValue("service")
+	fromVersion := r.FormValue("from_version")
+	toVersion := r.FormValue("to_version")
+	if service == "" || fromVersion == "" || toVersion == "" {
+		httpFailure(w, r, errors.New("Please supply a service, from_version and to_version"))
+		return
+	}
+
+	// only the documented filters, service and versions select the results
+	filter := url.Values{}
+	for _, name := range archive.SelectFilters {
+		if values, ok := r.Form[name]; ok {
+			filter[name] = values
+		}
+	}
+
+	ids, err := archive.Select(ctx, r.Form["sha256"], filter)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	summary := &resultDiffSummary{
+		ServiceName: service,
+		FromVersion: fromVersion,
+		ToVersion:   toVersion,
+		Changed:     make(map[string]int),
+		Missing:     []string{},
+		Failed:      make(map[string]string),
+		Paths:       []*resultDiffPath{},
+	}
+	paths := make(map[string]*resultDiffPath)
+
+	for _, sha256 := range ids {
+		from, to, err := resultVersions(sha256, service, fromVersion, toVersion)
+		if err != nil {
+			summary.Failed[sha256] = err.Error()
+			continue
+		}
+		if from == nil || to == nil {
+			summary.Missing = append(summary.Missing, sha256)
+			continue
+		}
+
+		d, err := resultDiffCompute(from, to)
+		if err != nil {
+			summary.Failed[sha256] = err.Error()
+			continue
+		}
+
+		summary.Compared++
+		if len(d.Changes) == 0 {
+			summary.Identical++
+			continue
+		}
+		summary.Changed[sha256] = len(d.Changes)
+
+		// every field counts once per object
+		seen := make(map[string]bool)
+		for _, change := range d.Changes {
+			key := change.Kind + " " + change.Pattern()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			p, ok := paths[key]
+			if !ok {
+				p = &resultDiffPath{Path: change.Pattern(), Kind: change.Kind}
+				paths[key] = p
+				summary.Paths = append(summary.Paths, p)
+			}
+			p.Objects++
+		}
+	}
+
+	sort.SliceStable(summary.Paths, func(i, j int) bool {
+		return summary.Paths[i].Objects > summary.Paths[j].Objects
+	})
+
+	httpSuccess(w, r, summary)
+}
+
+// ingestStatus reports whether the ingestion is currently running,
+// throttled, buffering or paused because of a slow or failing storage,
+// along with the usage of the write-ahead buffer.
+func ingestStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	httpSuccess(w, r, ingest.CurrentStatus())
+}
+
+// sampleGet serves a sample. If the sample is stored compressed and the
+// "compressed" parameter is set, the compressed stream is served as is and
+// its codec is named in the X-Holmes-Encoding header. With "format=zip" the
+// sample is served in a password protected zip archive instead, so virus
+// scanners on the way don't delete it.
 func sampleGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	sample, err := ctx.Objects.SampleGet(strings.ToLower(ps.ByName("sha256")))
+	var (
+		sample *objectStorage.Sample
+		err    error
+	)
+
+	format := r.FormValue("format")
+	if format != "" && format != "zip" {
+		httpFailure(w, r, errors.New("Unknown format: "+format))
+		return
+	}
+
+	var compressed *objectStorage.Compressed
+	for _, layer := range objectStorage.Layers(ctx.Objects) {
+		if c, ok := layer.(*objectStorage.Compressed); ok {
+			compressed = c
+		}
+	}
+
+	// the compressed stream can't be verified, only the decoded sample
+	get := ctx.Objects.SampleGet
+	if compressed != nil && r.FormValue("compressed") != "" && format == "" {
+		get = compressed.SampleGetEncoded
+	}
+
+	id := strings.ToLower(ps.ByName("sha256"))
+	sample, err = get(id)
+	if err != nil {
+		// generic objects are served by the payload they carry
+		if payload := genericData(id); payload != "" {
+			sample, err = get(payload)
+		}
+	}
 
 	if err != nil {
 		httpFailure(w, r, err)
 		return
 	}
 
+	if format == "zip" {
+		var buf bytes.Buffer
+		z := archive.NewZipWriter(&buf, ctx.Config.ArchivePassword)
+		if err = z.Add(sampleName(sample.SHA256), time.Now(), sample.Data); err == nil {
+			err = z.Close()
+		}
+		if err != nil {
+			httpFailure(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", "attachment; filename="+sample.SHA256+".zip")
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write(buf.Bytes())
+		return
+	}
+
 	// TODO: Find way to supply a real name with sample
-	w.Header().Set("Content-Disposition", "attachment; filename="+sample.SHA256)
+	filename := sample.SHA256
+	switch sample.Encoding {
+	case "gzip":
+		filename += ".gz"
+	case "zstd":
+		filename += ".zst"
+	}
+	if sample.Encoding != "" {
+		w.Header().Set("X-Holmes-Encoding", sample.Encoding)
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
 	w.Header().Set("Content-Type", "application/octet-stream")
 	fmt.Fprint(w, string(sample.Data))
 }
 
+// sampleExport streams the samples listed in "sha256" and/or selected by
+// a filter in one archive, see archive.Select for the filters. The format
+// is chosen by "format" (tar, tar.gz or zip).
+func sampleExport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseForm()
+
+	export := &archive.Export{
+		Format:   r.FormValue("format"),
+		Password: ctx.Config.ArchivePassword,
+	}
+	ext, err := export.Extension()
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	ids, err := archive.Select(ctx, r.Form["sha256"], r.Form)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename=export"+ext)
+	w.Header().Set("Content-Type", export.ContentType())
+
+	// the response already started, so errors can only be logged
+	if err = export.Run(ctx, w, ids); err != nil {
+		ctx.Warning.Println("Export failed:", err.Error())
+		return
+	}
+
+	ctx.Debug.Println("Exported", export.Exported, "samples,", export.Failed, "failed")
+}
+
+// genericData returns the sha256 of the payload of a generic object, or
+// an empty string if there is none.
+func genericData(id string) string {
+	object, err := ctx.Data.ObjectGet(id)
+	if err != nil || object.Type != "generic" || object.GenericDataRelAddress == "" {
+		return ""
+	}
+
+	_, payload, err := objectStorage.ParseRelAddress(object.GenericDataRelAddress)
+	if err != nil {
+		return ""
+	}
+
+	return payload
+}
+
+// genericDataStore attaches a payload, uploaded as "data", to a generic
+// object. The payload is stored like a sample and can be fetched through
+// /api/v2/raw_data/ by its own sha256 or the one of the object.
+func genericDataStore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	r.ParseMultipartForm(1024 * 1024 * 20)
+
+	object, err := ctx.Data.ObjectGet(strings.ToLower(ps.ByName("sha256")))
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+	if object.Type != "generic" {
+		httpFailure(w, r, errors.New("Only generic objects can carry data, this is a "+object.Type))
+		return
+	}
+
+	file, _, err := r.FormFile("data")
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	sample := &objectStorage.Sample{
+		SHA256: fmt.Sprintf("%x", sha256.Sum256(data)),
+		Data:   data,
+		Type:   "generic",
+	}
+
+	// payloads are content addressed, so identical ones are stored once
+	// unless a replica is missing them
+	info, err := ctx.Objects.SampleStat(sample.SHA256)
+	if err == nil && (!info.Exists || info.Incomplete) {
+		err = ctx.Objects.SampleStore(sample)
+	}
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	object.GenericDataRelAddress = objectStorage.RelAddress(sample.Type, sample.SHA256)
+	if err = ctx.Data.ObjectGenericDataStore(object.SHA256, object.GenericDataRelAddress); err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+
+	httpSuccess(w, r, object)
+}
+
+// sampleName returns the name a sample was first submitted with, or its
+// sha256 if the name is unknown. Submissions without a usable name are
+// skipped for the next older one.
+func sampleName(sha256 string) string {
+	submissions, err := ctx.Data.SubmissionsGetByObject(sha256)
+	if err != nil {
+		return sha256
+	}
+
+	// submissions are ordered by their id, not by their date
+	sort.SliceStable(submissions, func(i, j int) bool {
+		return submissions[i].DateTime.Before(submissions[j].DateTime)
+	})
+
+	for _, submission := range submissions {
+		// names can contain the path on the submitter's machine
+		name := filepath.Base(strings.Replace(submission.ObjName, "\\", "/", -1))
+		if name != "" && name != "." && name != "/" {
+			return name
+		}
+	}
+
+	return sha256
+}
+
+// sampleStat answers whether a sample is stored without sending it. The
+// size, hashes, mime type and timestamps are returned in the headers, 404
+// is returned if the sample isn't stored.
+func sampleStat(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := strings.ToLower(ps.ByName("sha256"))
+
+	info, err := ctx.Objects.SampleStat(id)
+	if err == nil && !info.Exists {
+		if payload := genericData(id); payload != "" {
+			info, err = ctx.Objects.SampleStat(payload)
+		}
+	}
+	if err != nil {
+		httpFailureHard(w, r, err)
+		return
+	}
+
+	if !info.Exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// the hashes and mime type are only known to the database
+	object, err := ctx.Data.ObjectGet(id)
+	if err != nil && err != dataStorage.ErrNotFound {
+		httpFailureHard(w, r, err)
+		return
+	}
+	if err == nil {
+		w.Header().Set("X-Holmes-SHA1", object.SHA1)
+		w.Header().Set("X-Holmes-MD5", object.MD5)
+		w.Header().Set("X-Holmes-Mime", object.FileMime)
+		w.Header().Set("X-Holmes-Created", object.CreationDateTime.UTC().Format(time.RFC3339))
+	}
+
+	w.Header().Set("X-Holmes-SHA256", info.SHA256)
+	w.Header().Set("X-Holmes-Stored-Size", strconv.FormatInt(info.StoredSize, 10))
+	if info.Encoding != "" {
+		w.Header().Set("X-Holmes-Encoding", info.Encoding)
+	}
+
+	w.Header().Set("Last-Modified", info.Modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+}
+
 // sampleStore is used to validate and store incoming samples. If everything
 // looks good it builds the structs and hands them to sampleStoreEverything.
 func sampleStore(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -176,7 +1075,7 @@ func sampleStore(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		r.FormValue("name") == "" ||
 		r.FormValue("date") == "" {
 
-		errMsg := fmt.Sprintf("user_id: %d, source: %s, name: %s, date: %s", userId, r.FormValue("source"), r.FormValue("name"), r.FormValue("date"))
+		errMsg := fmt.Sprintf("user_id: %s, source: %s, name: %s, date: %s", userId, r.FormValue("source"), r.FormValue("name"), r.FormValue("date"))
 		httpFailure(w, r, errors.New("Please supply all necessary values! "+errMsg))
 		return
 	}
@@ -212,6 +1111,9 @@ func sampleStore(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	hMD5.Write(fileBytes)
 	md5String := fmt.Sprintf("%x", hMD5.Sum(nil))
 
+	sha512String := fmt.Sprintf("%x", sha512.Sum512(fileBytes))
+	formats := hashes.FormatDigests(fileBytes)
+
 	// get mimetype
 	mimeType, err := getMimeFromMagic(fileBytes, 0)
 	if err != nil {
@@ -221,15 +1123,21 @@ func sampleStore(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 	// create structs for db
 	object := &dataStorage.Object{
-		Type:             "file",
-		CreationDateTime: time.Now(),
-		SHA256:           sha256String,
-		SHA1:             sha1String,
-		MD5:              md5String,
-		FileMime:         mimeType,
-		Source:           []string{""},
-		FileName:         []string{""},
-		Submissions:      []string{""},
+		Type:              "file",
+		CreationDateTime:  time.Now(),
+		SHA256:            sha256String,
+		SHA1:              sha1String,
+		MD5:               md5String,
+		SHA512:            sha512String,
+		FileMime:          mimeType,
+		FileTLSH:          hashes.TLSH(fileBytes),
+		FileSSDeep:        hashes.SSDeep(fileBytes),
+		FileImphash:       formats.Imphash,
+		FileSectionHashes: formats.SectionHashes,
+		FileELFImportHash: formats.ELFImportHash,
+		Source:            []string{""},
+		FileName:          []string{""},
+		Submissions:       []string{""},
 	}
 
 	date, err := time.Parse(time.RFC3339, r.FormValue("date"))
@@ -253,14 +1161,16 @@ func sampleStore(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		Data:   fileBytes,
 	}
 
-	inserted, err := httpStoreEverything(submission, object, sample)
+	inserted, uploaded, err := httpStoreEverything(submission, object, sample)
 	if err != nil {
 		// Remove all database entries
-		ctx.Data.SubmissionDelete(submission.Id)
+		ctx.Data.SubmissionDelete(submission)
+		if uploaded {
+			// Only delete sample in ObjectStore, if it wasn't stored before
+			ctx.Objects.SampleDelete(sample)
+		}
 		if inserted {
-			// Only delete sample in ObjectStore, if it didn't exist before
 			ctx.Data.ObjectDelete(object.SHA256)
-			ctx.Objects.SampleDelete(sample)
 		} else {
 			// If the sample did exist before, the filename- and source- fields were updated, so that needs to be reverted
 			ctx.Data.ObjectUpdate(object.SHA256)
@@ -275,25 +1185,218 @@ func sampleStore(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 // httpStoreEverything accepts a submission, object and sample struct pointer and
 // tries to save them using the configured storage engines. It returns a boolean value
-// indicating if the sample file was already known (resubmitted) and an error.
-func httpStoreEverything(submission *dataStorage.Submission, object *dataStorage.Object, sample *objectStorage.Sample) (bool, error) {
+// indicating if the object was previously unknown, one indicating if the sample file
+// was uploaded and an error.
+func httpStoreEverything(submission *dataStorage.Submission, object *dataStorage.Object, sample *objectStorage.Sample) (bool, bool, error) {
 	// save structs to db
 	err := ctx.Data.SubmissionStore(submission)
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 
 	inserted, err := ctx.Data.ObjectStore(object)
 	if err != nil {
-		return inserted, err
+		return inserted, false, err
 	}
 
-	// only insert the sample, if it wasn't known before
-	if inserted {
-		err = ctx.Objects.SampleStore(sample)
+	if err = fuzzyHashIndex(object); err != nil {
+		return inserted, false, err
+	}
+
+	// only upload the sample, if its bytes aren't stored yet. A known object
+	// can still be missing them, if a previous upload failed, or be missing
+	// on some of the replicas.
+	info, err := ctx.Objects.SampleStat(sample.SHA256)
+	if err != nil {
+		return inserted, false, err
+	}
+	if info.Exists && !info.Incomplete {
+		return inserted, false, nil
+	}
+
+	return inserted, true, ctx.Objects.SampleStore(sample)
+}
+
+// fuzzyHashIndex adds the fuzzy hashes of a file object to the index.
+func fuzzyHashIndex(object *dataStorage.Object) error {
+	if object.FileTLSH != "" {
+		bucket, err := hashes.TLSHBucket(object.FileTLSH)
+		if err != nil {
+			return err
+		}
+		err = ctx.Data.FuzzyHashStore(&dataStorage.FuzzyHash{
+			Algorithm: "tlsh",
+			Bucket:    bucket,
+			SHA256:    object.SHA256,
+			Hash:      object.FileTLSH,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if object.FileSSDeep != "" {
+		bucket, err := hashes.SSDeepBucket(object.FileSSDeep)
+		if err != nil {
+			return err
+		}
+		return ctx.Data.FuzzyHashStore(&dataStorage.FuzzyHash{
+			Algorithm: "ssdeep",
+			Bucket:    bucket,
+			SHA256:    object.SHA256,
+			Hash:      object.FileSSDeep,
+		})
+	}
+
+	return nil
+}
+
+// tlshMatch is an object within the TLSH distance, lower is closer.
+type tlshMatch struct {
+	SHA256   string `json:"sha256"`
+	Hash     string `json:"hash"`
+	Distance int    `json:"distance"`
+}
+
+// ssdeepMatch is an object above the ssdeep score, higher is closer.
+type ssdeepMatch struct {
+	SHA256 string `json:"sha256"`
+	Hash   string `json:"hash"`
+	Score  int    `json:"score"`
+}
+
+type similarity struct {
+	TLSH     string         `json:"tlsh,omitempty"`
+	SSDeep   string         `json:"ssdeep,omitempty"`
+	ByTLSH   []*tlshMatch   `json:"by_tlsh"`
+	BySSDeep []*ssdeepMatch `json:"by_ssdeep"`
+}
+
+// similarGet finds the file objects similar to the object "sha256", the
+// fuzzy hashes "tlsh" and "ssdeep" or an uploaded "sample". Objects match
+// if their TLSH distance is at most "tlsh_distance" (default: 70) or their
+// ssdeep score at least "ssdeep_score" (default: 50). "limit" caps the
+// number of hashes compared per bucket.
+func similarGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r.ParseMultipartForm(1024 * 1024 * 20)
+
+	result := &similarity{
+		TLSH:     r.FormValue("tlsh"),
+		SSDeep:   r.FormValue("ssdeep"),
+		ByTLSH:   []*tlshMatch{},
+		BySSDeep: []*ssdeepMatch{},
+	}
+	self := strings.ToLower(r.FormValue("sha256"))
+
+	if self != "" {
+		object, err := ctx.Data.ObjectGet(self)
+		if err != nil {
+			httpFailure(w, r, err)
+			return
+		}
+		result.TLSH, result.SSDeep = object.FileTLSH, object.FileSSDeep
+	} else if file, _, err := r.FormFile("sample"); err == nil {
+		defer file.Close()
+
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			httpFailure(w, r, err)
+			return
+		}
+		result.TLSH, result.SSDeep = hashes.TLSH(data), hashes.SSDeep(data)
+	}
+
+	if result.TLSH == "" && result.SSDeep == "" {
+		httpFailure(w, r, errors.New("Please supply a sha256, sample, tlsh or ssdeep hash with fuzzy hashes"))
+		return
+	}
+
+	maxDistance, err := formInt(r, "tlsh_distance", 70)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+	minScore, err := formInt(r, "ssdeep_score", 50)
+	if err != nil {
+		httpFailure(w, r, err)
+		return
+	}
+	limit, err := formInt(r, "limit", 10000)
+	if err != nil || limit <= 0 {
+		httpFailure(w, r, errors.New("Invalid limit: "+r.FormValue("limit")))
+		return
+	}
+
+	if result.TLSH != "" {
+		buckets, err := hashes.TLSHBuckets(result.TLSH, maxDistance)
+		if err != nil {
+			httpFailure(w, r, err)
+			return
+		}
+
+		for _, bucket := range buckets {
+			candidates, err := ctx.Data.FuzzyHashSearch("tlsh", bucket, limit)
+			if err != nil {
+				httpFailure(w, r, err)
+				return
+			}
+
+			for _, c := range candidates {
+				distance, err := hashes.TLSHDistance(result.TLSH, c.Hash)
+				if err == nil && distance <= maxDistance && c.SHA256 != self {
+					result.ByTLSH = append(result.ByTLSH, &tlshMatch{SHA256: c.SHA256, Hash: c.Hash, Distance: distance})
+				}
+			}
+		}
+
+		sort.Slice(result.ByTLSH, func(i, j int) bool {
+			return result.ByTLSH[i].Distance < result.ByTLSH[j].Distance
+		})
+	}
+
+	if result.SSDeep != "" {
+		buckets, err := hashes.SSDeepBuckets(result.SSDeep)
+		if err != nil {
+			httpFailure(w, r, err)
+			return
+		}
+
+		for _, bucket := range buckets {
+			candidates, err := ctx.Data.FuzzyHashSearch("ssdeep", bucket, limit)
+			if err != nil {
+				httpFailure(w, r, err)
+				return
+			}
+
+			for _, c := range candidates {
+				score, err := hashes.SSDeepCompare(result.SSDeep, c.Hash)
+				if err == nil && score >= minScore && score > 0 && c.SHA256 != self {
+					result.BySSDeep = append(result.BySSDeep, &ssdeepMatch{SHA256: c.SHA256, Hash: c.Hash, Score: score})
+				}
+			}
+		}
+
+		sort.Slice(result.BySSDeep, func(i, j int) bool {
+			return result.BySSDeep[i].Score > result.BySSDeep[j].Score
+		})
 	}
 
-	return inserted, err
+	httpSuccess(w, r, result)
+}
+
+// formInt returns the integer form value key, or def if it isn't set.
+func formInt(r *http.Request, key string, def int) (int, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.New("Invalid " + key + ": " + v)
+	}
+
+	return i, nil
 }
 
 func configGet(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -363,6 +1466,12 @@ func httpGenericRequestHandler(w http.ResponseWriter, r *http.Request) {
 // httpSuccess builds the default http response for a successfull request
 // and writes to the ResponseWriter.
 func httpSuccess(w http.ResponseWriter, r *http.Request, result interface{}) {
+	httpRespond(w, r, http.StatusOK, result)
+}
+
+// httpRespond is httpSuccess with a different status code, e.g. 202 for
+// requests which are completed later.
+func httpRespond(w http.ResponseWriter, r *http.Request, status int, result interface{}) {
 	j, err := json.Marshal(apiResponse{
 		ResponseCode: 0,
 		Result:       result,
@@ -374,6 +1483,7 @@ func httpSuccess(w http.ResponseWriter, r *http.Request, result interface{}) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(j)
 }
 
@@ -405,6 +1515,167 @@ func httpFailureHard(w http.ResponseWriter, r *http.Request, err interface{}) {
 	http.Error(w, "Server error!", 500)
 }
 
+// healthz answers as long as the server handles requests, the
+// dependencies are checked by readyz.
+func healthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	httpSuccess(w, r, "ok")
+}
+
+// componentStatus is the result of the readiness check of a dependency.
+type componentStatus struct {
+	Name    string  `json:"name"`
+	Ready   bool    `json:"ready"`
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// readyTimeout is the time a dependency has to answer the readiness check.
+const readyTimeout = 5 * time.Second
+
+// readyProbe is a running check of a dependency, err is set once done is
+// closed.
+type readyProbe struct {
+	done chan struct{}
+	err  error
+}
+
+// readyProbes are the checks which didn't return yet. A check which
+// hangs isn't started again until it returns, later requests wait for
+// the running one instead, so a wedged dependency can't pile up
+// goroutines (or waiters for the mimeLock).
+var (
+	readyLock   = &sync.Mutex{}
+	readyProbes = make(map[string]*readyProbe)
+)
+
+// startProbe runs the check of a dependency unless it is still running.
+func startProbe(name string, ping func() error) *readyProbe {
+	readyLock.Lock()
+	defer readyLock.Unlock()
+
+	if p, ok := readyProbes[name]; ok {
+		return p
+	}
+
+	p := &readyProbe{done: make(chan struct{})}
+	readyProbes[name] = p
+	go func() {
+		p.err = ping()
+
+		readyLock.Lock()
+		delete(readyProbes, name)
+		readyLock.Unlock()
+		close(p.done)
+	}()
+
+	return p
+}
+
+// readyCheck is an additional dependency checked by readyz.
+type readyCheck struct {
+	name string
+	ping func() error
+}
+
+var extraReadyChecks []readyCheck
+
+// AddReadyCheck adds a dependency to the readiness check, e.g. a service
+// started next to the ingestion. It has to be called before Start.
+func AddReadyCheck(name string, ping func() error) {
+	extraReadyChecks = append(extraReadyChecks, readyCheck{name, ping})
+}
+
+// readyz checks the data and object storage, the ingestion sources,
+// libmagic and the added checks in parallel and reports the status and latency of each. The
+// response is a 503 if any of them fails or doesn't answer in time, so a
+// wedged instance can be told from a healthy one.
+func readyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	checks := []readyCheck{
+		{"data_storage", ctx.Data.Ping},
+		{"object_storage", ctx.Objects.Ping},
+		{"libmagic", magicPing},
+	}
+	for _, source := range ingest.Sources() {
+		checks = append(checks, readyCheck{"ingest_" + source.Name(), source.Ping})
+	}
+	checks = append(checks, extraReadyChecks...)
+
+	statuses := make([]*componentStatus, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		statuses[i] = &componentStatus{Name: c.name}
+
+		wg.Add(1)
+		go func(status *componentStatus, ping func() error) {
+			defer wg.Done()
+
+			start := time.Now()
+			probe := startProbe(status.Name, ping)
+
+			var err error
+			select {
+			case <-probe.done:
+				err = probe.err
+			case <-time.After(readyTimeout):
+				err = errors.New("No answer within " + readyTimeout.String())
+			}
+
+			status.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+			status.Ready = err == nil
+			if err != nil {
+				status.Error = err.Error()
+			}
+		}(statuses[i], c.ping)
+	}
+	wg.Wait()
+
+	response := apiResponse{
+		ResponseCode: 0,
+		Result:       statuses,
+	}
+	for _, status := range statuses {
+		if !status.Ready {
+			response.ResponseCode = 1
+			response.Failure = "Not ready: " + status.Name + " failed"
+			break
+		}
+	}
+
+	j, err := json.Marshal(response)
+	if err != nil {
+		httpFailureHard(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if response.ResponseCode != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(j)
+}
+
+// magicPing checks that libmagic can be loaded and identifies a buffer.
+// It shares the mimeLock with the uploads, libmagic isn't thread safe;
+// startProbe makes sure only one check waits for it.
+func magicPing() (err error) {
+	mimeLock.Lock()
+	defer mimeLock.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("libmagic paniced: %v", r)
+		}
+	}()
+
+	if err = magicmime.Open(magicmime.MAGIC_ERROR); err != nil {
+		return errors.New("libmagic is not installed: " + err.Error())
+	}
+	defer magicmime.Close()
+
+	_, err = magicmime.TypeByBuffer([]byte("#!/bin/sh\n"))
+	return err
+}
+
 // getMimeFromMagic accepts a sample and counter and then tries to determin the
 // mime type of the file. If a panic occures in an external library the function
 // will recover and try to get the mime type up to three times before returning
@@ -0,0 +1,231 @@
+package ingest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Storage/context"
+)
+
+const (
+	StateRunning   = "running"
+	StateThrottled = "throttled"
+	StatePaused    = "paused"
+	StateBuffering = "buffering" // paused, but results go to the Buffer
+)
+
+// Backpressure tracks the latency and error rate of the storage while
+// results are stored. Sources are supposed to consume slower while the
+// state is throttled and to stop consuming while it is paused. A paused
+// ingestion is resumed once a probe against the storage succeeds again.
+type Backpressure struct {
+	// MaxLatency throttles the ingestion if the average time to store
+	// a result exceeds it.
+	MaxLatency time.Duration
+
+	// MaxErrorRate pauses the ingestion if the share of failed results
+	// exceeds it.
+	MaxErrorRate float64
+
+	// Window is the number of results the averages are roughly taken
+	// over.
+	Window int
+
+	// ProbeInterval is the time between two probes while paused.
+	ProbeInterval time.Duration
+
+	lock      sync.RWMutex
+	state     string
+	since     time.Time
+	latency   time.Duration
+	errorRate float64
+	observed  int
+	resumed   chan struct{}
+}
+
+// Status reports the state of the ingestion.
+type Status struct {
+	State        string              `json:"state"`
+	Backpressure *BackpressureStatus `json:"backpressure"`
+	Buffer       *WALStatus          `json:"buffer,omitempty"`
+}
+
+// BackpressureStatus is a snapshot of the backpressure state.
+type BackpressureStatus struct {
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Latency   string    `json:"latency"`
+	ErrorRate float64   `json:"error_rate"`
+}
+
+// Pressure is shared by all sources and fed by Handle.
+var Pressure = &Backpressure{}
+
+// CurrentStatus reports the effective state of the ingestion together
+// with the backpressure and buffer details.
+func CurrentStatus() *Status {
+	status := &Status{
+		State:        State(),
+		Backpressure: Pressure.Status(),
+	}
+	if Buffer != nil {
+		status.Buffer = Buffer.Status()
+	}
+
+	return status
+}
+
+// Start applies the configured thresholds and starts probing the storage
+// whenever the ingestion gets paused.
+func (b *Backpressure) Start(c *context.Ctx) {
+	b.lock.Lock()
+	b.MaxLatency = time.Duration(c.Config.BackpressureLatency) * time.Millisecond
+	if b.MaxLatency <= 0 {
+		b.MaxLatency = time.Second * 2
+	}
+	b.MaxErrorRate = c.Config.BackpressureErrorRate
+	if b.MaxErrorRate <= 0 {
+		b.MaxErrorRate = 0.5
+	}
+	b.ProbeInterval = time.Duration(c.Config.BackpressureProbe) * time.Second
+	if b.ProbeInterval <= 0 {
+		b.ProbeInterval = time.Second * 10
+	}
+	if b.Window <= 0 {
+		b.Window = 20
+	}
+	b.reset()
+	b.lock.Unlock()
+
+	go b.probe(c)
+}
+
+// reset has to be called with the lock held.
+func (b *Backpressure) reset() {
+	b.state = StateRunning
+	b.since = time.Now()
+	b.latency = 0
+	b.errorRate = 0
+	b.observed = 0
+	if b.resumed != nil {
+		close(b.resumed)
+	}
+	b.resumed = make(chan struct{})
+}
+
+// Observe records the time it took to store a result and whether it
+// failed because of the storage.
+func (b *Backpressure) Observe(latency time.Duration, failed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.Window <= 0 || b.state == StatePaused {
+		// not started or nothing to learn until the probe succeeds
+		return
+	}
+
+	// exponential moving averages over roughly Window results
+	alpha := 2 / (float64(b.Window) + 1)
+	failure := 0.0
+	if failed {
+		failure = 1
+	}
+	b.latency = time.Duration(alpha*float64(latency) + (1-alpha)*float64(b.latency))
+	b.errorRate = alpha*failure + (1-alpha)*b.errorRate
+	b.observed++
+
+	// don't judge the storage by the first few results
+	if b.observed < b.Window/2 {
+		return
+	}
+
+	state := StateRunning
+	if b.errorRate > b.MaxErrorRate {
+		state = StatePaused
+	} else if b.latency > b.MaxLatency {
+		state = StateThrottled
+	}
+
+	if state != b.state {
+		b.state = state
+		b.since = time.Now()
+	}
+}
+
+// State returns the current state.
+func (b *Backpressure) State() string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.currentState()
+}
+
+// currentState has to be called with the lock held.
+func (b *Backpressure) currentState() string {
+	if b.state == "" {
+		return StateRunning
+	}
+	return b.state
+}
+
+// Wait blocks while the ingestion is paused.
+func (b *Backpressure) Wait() {
+	b.lock.RLock()
+	paused := b.currentState() == StatePaused
+	resumed := b.resumed
+	b.lock.RUnlock()
+
+	// reset closes the channel we got while paused
+	if paused && resumed != nil {
+		<-resumed
+	}
+}
+
+// Status returns a snapshot of the current state.
+func (b *Backpressure) Status() *BackpressureStatus {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return &BackpressureStatus{
+		State:     b.currentState(),
+		Since:     b.since,
+		Latency:   b.latency.String(),
+		ErrorRate: b.errorRate,
+	}
+}
+
+// probe regularly checks a paused storage and resumes the ingestion once
+// it answers in time again.
+func (b *Backpressure) probe(c *context.Ctx) {
+	for {
+		time.Sleep(b.ProbeInterval)
+
+		if b.State() != StatePaused {
+			continue
+		}
+
+		if !b.recovered(c.Data.Ping, c.Objects.Ping) {
+			c.Debug.Println("Storage still unhealthy, ingestion stays paused")
+			continue
+		}
+
+		c.Info.Println("Storage recovered, resuming ingestion")
+		b.lock.Lock()
+		b.reset()
+		b.lock.Unlock()
+	}
+}
+
+// recovered pings every storage and reports whether all of them answered
+// without error within MaxLatency.
+func (b *Backpressure) recovered(pings ...func() error) bool {
+	for _, ping := range pings {
+		start := time.Now()
+		err := ping()
+		if err != nil || time.Since(start) > b.MaxLatency {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,133 @@
+package ingest
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type observation struct {
+	latency time.Duration
+	failed  bool
+}
+
+func repeat(n int, o observation) []observation {
+	observations := make([]observation, n)
+	for i := range observations {
+		observations[i] = o
+	}
+	return observations
+}
+
+func TestBackpressureObserve(t *testing.T) {
+	var (
+		fast = observation{time.Millisecond * 10, false}
+		slow = observation{time.Second * 3, false}
+		fail = observation{time.Millisecond * 10, true}
+	)
+
+	tests := []struct {
+		name         string
+		observations []observation
+		state        string
+	}{
+		{"healthy", repeat(20, fast), StateRunning},
+		{"too few results to judge", repeat(4, fail), StateRunning},
+		{"error rate above threshold", repeat(5, fail), StatePaused},
+		// 5 results at 3s average 1.9s, the 6th lifts the average to 2.1s
+		{"latency below threshold", repeat(5, slow), StateRunning},
+		{"latency above threshold", repeat(6, slow), StateThrottled},
+		{"throttled recovers", append(repeat(6, slow), fast), StateRunning},
+		{"errors beat latency", append(repeat(6, slow), repeat(5, fail)...), StatePaused},
+		{"paused ignores results", append(repeat(5, fail), repeat(20, fast)...), StatePaused},
+		{"occasional errors", append(repeat(10, fast), fail, fast, fast, fail, fast, fast, fail), StateRunning},
+	}
+
+	for _, test := range tests {
+		b := &Backpressure{
+			MaxLatency:   time.Second * 2,
+			MaxErrorRate: 0.5,
+			Window:       10,
+		}
+		b.reset()
+
+		for _, o := range test.observations {
+			b.Observe(o.latency, o.failed)
+		}
+
+		if state := b.State(); state != test.state {
+			t.Errorf("%s: state is %s, expected %s (%+v)", test.name, state, test.state, b.Status())
+		}
+	}
+}
+
+func TestBackpressureNotStarted(t *testing.T) {
+	b := &Backpressure{}
+	for i := 0; i < 20; i++ {
+		b.Observe(time.Second, true)
+	}
+
+	if state := b.State(); state != StateRunning {
+		t.Errorf("state is %s, expected %s", state, StateRunning)
+	}
+}
+
+func TestBackpressureRecovered(t *testing.T) {
+	var (
+		ok   = func() error { return nil }
+		down = func() error { return errors.New("down") }
+		slow = func() error {
+			time.Sleep(time.Millisecond * 50)
+			return nil
+		}
+	)
+
+	tests := []struct {
+		name      string
+		pings     []func() error
+		recovered bool
+	}{
+		{"both answer", []func() error{ok, ok}, true},
+		{"data storage down", []func() error{down, ok}, false},
+		{"object storage down", []func() error{ok, down}, false},
+		{"too slow", []func() error{ok, slow}, false},
+	}
+
+	for _, test := range tests {
+		b := &Backpressure{MaxLatency: time.Millisecond * 20}
+		if recovered := b.recovered(test.pings...); recovered != test.recovered {
+			t.Errorf("%s: recovered is %v, expected %v", test.name, recovered, test.recovered)
+		}
+	}
+}
+
+func TestBackpressureWait(t *testing.T) {
+	b := &Backpressure{MaxLatency: time.Second, MaxErrorRate: 0.5, Window: 2}
+	b.reset()
+	b.Observe(0, true)
+	if state := b.State(); state != StatePaused {
+		t.Fatalf("state is %s, expected %s", state, StatePaused)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		b.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Wait returned while paused")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	b.lock.Lock()
+	b.reset()
+	b.lock.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return after the ingestion was resumed")
+	}
+}
@@ -0,0 +1,304 @@
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Storage/context"
+	"github.com/HolmesProcessing/Holmes-Storage/dataStorage"
+)
+
+// Source is a transport totem results are received from. Every source
+// hands the raw result messages to Handle, so all of them share the
+// same validation and storage pipeline.
+type Source interface {
+	// Name identifies the source in log messages.
+	Name() string
+
+	// Run consumes results until the source breaks down. It only
+	// returns on errors.
+	Run(c *context.Ctx) error
+
+	// Ping reports whether the source is able to receive results,
+	// it is called by the readiness check.
+	Ping() error
+}
+
+type totemResult struct {
+	Filename string   `json:"filename"`
+	Data     string   `json:"data"`
+	Tags     []string `json:"tags"`
+	MD5      string   `json:"md5"`
+	SHA1     string   `json:"sha1"`
+	SHA256   string   `json:"sha256"`
+
+	// ObjectType is one of file (default), domain, ip, email or generic.
+	// Non-file objects are identified by Identifier instead of SHA256.
+	ObjectType  string `json:"object_type"`
+	Identifier  string `json:"identifier"`
+	GenericType string `json:"generic_type"`
+
+	// ServiceName is only used if the transport doesn't supply the
+	// name of the service itself (like the AMQP routing key does).
+	ServiceName string `json:"service_name"`
+}
+
+// invalidError marks results which can never be stored, retrying
+// them is pointless.
+type invalidError struct {
+	msg string
+}
+
+func (e *invalidError) Error() string {
+	return e.msg
+}
+
+func invalid(err error) error {
+	return &invalidError{err.Error()}
+}
+
+// IsInvalid reports whether err was caused by a malformed result. All
+// other errors returned by Handle are temporary and the result should
+// be retried later.
+func IsInvalid(err error) bool {
+	_, ok := err.(*invalidError)
+	return ok
+}
+
+var (
+	runningLock = &sync.Mutex{}
+	running     []Source
+)
+
+// Sources returns the sources started by Run.
+func Sources() []Source {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+
+	return running
+}
+
+// Run starts all sources and blocks until one of them fails.
+func Run(c *context.Ctx, sources []Source) {
+	if len(sources) == 0 {
+		c.Warning.Panicln("No ingestion source configured")
+	}
+
+	runningLock.Lock()
+	running = sources
+	runningLock.Unlock()
+
+	Pressure.Start(c)
+	if Buffer != nil {
+		go Buffer.Run(c)
+	}
+
+	failed := make(chan error)
+	for _, source := range sources {
+		go func(s Source) {
+			c.Info.Println("Starting ingestion source", s.Name())
+			err := s.Run(c)
+			if err == nil {
+				err = errors.New("stopped unexpectedly")
+			}
+			failed <- errors.New(s.Name() + ": " + err.Error())
+		}(source)
+	}
+
+	c.Warning.Panicln("Ingestion failed:", (<-failed).Error())
+}
+
+// State returns the state sources should act on. While the storage is
+// failing, results are buffered instead of pausing the ingestion as long
+// as a buffer is configured and has room left.
+func State() string {
+	state := Pressure.State()
+	if state == StatePaused && Buffer != nil && !Buffer.Full() {
+		return StateBuffering
+	}
+
+	return state
+}
+
+// Accept hands a raw totem result message to the pipeline like Handle,
+// but buffers it if it can't be stored right now and a buffer is
+// configured. A nil error means the result is either stored or safely
+// buffered, the returned result is nil in the latter case since it only
+// gets its id once the buffer is flushed.
+func Accept(c *context.Ctx, body []byte, serviceName string) (*dataStorage.Result, error) {
+	received := time.Now()
+
+	if State() == StateBuffering {
+		// don't bother the failing storage, but don't buffer garbage
+		if _, err := Validate(body, serviceName); err != nil {
+			return nil, err
+		}
+		return nil, Buffer.Append(body, serviceName, received)
+	}
+
+	result, err := handle(c, body, serviceName, received)
+	if err == nil || IsInvalid(err) || Buffer == nil {
+		return result, err
+	}
+
+	c.Warning.Println(err.Error(), "- buffering result")
+	if bufErr := Buffer.Append(body, serviceName, received); bufErr != nil {
+		return nil, errors.New(err.Error() + ", buffering failed: " + bufErr.Error())
+	}
+
+	return nil, nil
+}
+
+// Handle validates a raw totem result message and stores it. The
+// serviceName is taken from the message if it is empty.
+func Handle(c *context.Ctx, body []byte, serviceName string) (*dataStorage.Result, error) {
+	return handle(c, body, serviceName, time.Now())
+}
+
+func handle(c *context.Ctx, body []byte, serviceName string, received time.Time) (*dataStorage.Result, error) {
+	m, object, result, err := prepare(body, serviceName, received)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	err = store(c, m, object, result)
+	Pressure.Observe(time.Since(start), err != nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func store(c *context.Ctx, m *totemResult, object *dataStorage.Object, result *dataStorage.Result) error {
+	if object.Type != "file" {
+		if err := ensureObject(c, object, result.ServiceName, m); err != nil {
+			return errors.New("Failed to create object: " + err.Error() + " SHA256: " + object.SHA256)
+		}
+	}
+
+	if err := c.Data.ResultStore(result); err != nil {
+		return errors.New("Failed to safe result: " + err.Error() + " SHA256: " + object.SHA256)
+	}
+
+	return nil
+}
+
+// Validate runs a raw totem result message through the same checks as
+// Handle and returns the result that would be stored, without touching
+// the storage.
+func Validate(body []byte, serviceName string) (*dataStorage.Result, error) {
+	_, _, result, err := prepare(body, serviceName, time.Now())
+	return result, err
+}
+
+// prepare decodes and validates a raw totem result message and builds
+// the object it belongs to and the result to store.
+func prepare(body []byte, serviceName string, received time.Time) (*totemResult, *dataStorage.Object, *dataStorage.Result, error) {
+	m := &totemResult{}
+	if err := json.Unmarshal(body, m); err != nil {
+		return nil, nil, nil, invalid(errors.New("Could not decode msg: " + err.Error()))
+	}
+
+	/*
+		// This approach has been revised since the data is now
+		// saved as string and not as pure JSON document.
+
+		// since totem sends the results as json encoded string
+		// (which contains json) we need to unmarshal data
+		// and save it this way.
+		var resData interface{}
+		err = json.Unmarshal([]byte(m.Data), &resData)
+		if err != nil {
+			warning.Printf("Could not decode data: %s\n", m.Data)
+			msg.Nack(false, false)
+			return
+		}
+	*/
+
+	if serviceName == "" {
+		serviceName = m.ServiceName
+	}
+	if serviceName == "" {
+		return nil, nil, nil, invalid(errors.New("Result is missing the service name"))
+	}
+
+	object, err := resultObject(m)
+	if err != nil {
+		return nil, nil, nil, invalid(err)
+	}
+
+	// results for files keep their historic object type so they stay in
+	// the same partition as the results stored before
+	resultType := object.Type
+	if resultType == "file" {
+		resultType = "sample"
+	}
+
+	// TODO: Totem needs to send more data
+
+	// TODO: Totem needs to send hashes lowercase
+
+	// TODO: Totem needs to send execution time
+
+	// compress results using gzip
+	var resultsGZ bytes.Buffer
+	gz := gzip.NewWriter(&resultsGZ)
+	if _, err := gz.Write([]byte(m.Data)); err != nil {
+		return nil, nil, nil, errors.New("Failed to compress results (writer): " + err.Error() + " SHA256: " + object.SHA256)
+	}
+
+	if err := gz.Flush(); err != nil {
+		return nil, nil, nil, errors.New("Failed to compress results (flush): " + err.Error() + " SHA256: " + object.SHA256)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, nil, nil, errors.New("Failed to compress results (close): " + err.Error() + " SHA256: " + object.SHA256)
+	}
+
+	result := &dataStorage.Result{
+		Id:                "", //will be filled by the storage engine
+		SHA256:            object.SHA256,
+		SchemaVersion:     "1",
+		UserId:            "NotSend",
+		SourceId:          []string{"NotSend"},
+		SourceTag:         []string{"NotSend"},
+		ServiceName:       serviceName,
+		ServiceVersion:    "NotSend",
+		ServiceConfig:     "NotSend",
+		ObjectCategory:    []string{"NotSend"},
+		ObjectType:        resultType,
+		Results:           resultsGZ.Bytes(),
+		Tags:              m.Tags,
+		ExecutionTime:     received,
+		WatchguardStatus:  "NotImplemented",
+		WatchguardLog:     []string{"NotImplemented"},
+		WatchguardVersion: "NotImplemented",
+		Comment:           "",
+	}
+
+	return m, object, result, nil
+}
+
+// ResultData returns the output of the service a result holds, which is
+// stored gzip compressed.
+func ResultData(result *dataStorage.Result) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(result.Results))
+	if err != nil {
+		return nil, errors.New("Failed to decompress results of " + result.Id + ": " + err.Error())
+	}
+	defer gz.Close()
+
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, errors.New("Failed to decompress results of " + result.Id + ": " + err.Error())
+	}
+
+	return data, nil
+}
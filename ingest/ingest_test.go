@@ -0,0 +1,152 @@
+package ingest
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/HolmesProcessing/Holmes-Storage/context"
+	"github.com/HolmesProcessing/Holmes-Storage/dataStorage"
+)
+
+// downStorage stores results unless it is down. Only the methods used
+// for file results are implemented.
+type downStorage struct {
+	dataStorage.Storage
+
+	lock    sync.Mutex
+	down    bool
+	results []*dataStorage.Result
+}
+
+func (s *downStorage) ResultStore(result *dataStorage.Result) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.down {
+		return errors.New("connection refused")
+	}
+	result.Id = "stored"
+	s.results = append(s.results, result)
+	return nil
+}
+
+func (s *downStorage) setDown(down bool) {
+	s.lock.Lock()
+	s.down = down
+	s.lock.Unlock()
+}
+
+func (s *downStorage) stored() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.results)
+}
+
+const testResult = `{"sha256":"8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4","data":"{\"ok\":true}","service_name":"yara"}`
+
+// withBuffer runs fn with a fresh write-ahead buffer and a storage which
+// can be taken down.
+func withBuffer(t *testing.T, fn func(c *context.Ctx, storage *downStorage, dir string)) {
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := &WAL{Dir: filepath.Join(dir, "wal")}
+	if err = w.Open(); err != nil {
+		t.Fatal(err)
+	}
+	Buffer = w
+	defer func() { Buffer = nil }()
+
+	storage := &downStorage{}
+	discard := log.New(ioutil.Discard, "", 0)
+	fn(&context.Ctx{Data: storage, Debug: discard, Info: discard, Warning: discard}, storage, dir)
+}
+
+func TestAcceptBuffersWhileDown(t *testing.T) {
+	withBuffer(t, func(c *context.Ctx, storage *downStorage, dir string) {
+		storage.setDown(true)
+		result, err := Accept(c, []byte(testResult), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != nil {
+			t.Errorf("got result %s from a failing storage", result.Id)
+		}
+		if pending := Buffer.Status().Pending; pending != 1 {
+			t.Fatalf("%d results buffered, expected 1", pending)
+		}
+
+		// flushing fails as long as the storage is down
+		if err = Buffer.Flush(c); err == nil {
+			t.Error("flushed to a failing storage")
+		}
+
+		storage.setDown(false)
+		if err = Buffer.Flush(c); err != nil {
+			t.Fatal(err)
+		}
+		if stored := storage.stored(); stored != 1 {
+			t.Fatalf("%d results stored, expected 1", stored)
+		}
+		if name := storage.results[0].ServiceName; name != "yara" {
+			t.Errorf("recovered result of %s, expected yara", name)
+		}
+		if pending := Buffer.Status().Pending; pending != 0 {
+			t.Errorf("%d results still buffered", pending)
+		}
+
+		result, err = Accept(c, []byte(testResult), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result == nil || result.Id != "stored" {
+			t.Errorf("got %+v from a healthy storage, expected the stored result", result)
+		}
+	})
+}
+
+func TestAcceptRejectsInvalid(t *testing.T) {
+	withBuffer(t, func(c *context.Ctx, storage *downStorage, dir string) {
+		storage.setDown(true)
+		if _, err := Accept(c, []byte(`{"data":"{}"}`), ""); !IsInvalid(err) {
+			t.Errorf("got %v, expected an invalid result", err)
+		}
+		if pending := Buffer.Status().Pending; pending != 0 {
+			t.Errorf("%d invalid results buffered", pending)
+		}
+	})
+}
+
+func TestSpoolBuffersWhileDown(t *testing.T) {
+	withBuffer(t, func(c *context.Ctx, storage *downStorage, dir string) {
+		path := filepath.Join(dir, "result.json")
+		if err := ioutil.WriteFile(path, []byte(testResult), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		storage.setDown(true)
+		s := &Spool{Dir: dir}
+		s.handleFile(c, path, filepath.Join(dir, "failed"))
+
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Error("buffered spool file wasn't removed")
+		}
+
+		storage.setDown(false)
+		if err := Buffer.Flush(c); err != nil {
+			t.Fatal(err)
+		}
+		if stored := storage.stored(); stored != 1 {
+			t.Errorf("%d results stored, expected 1", stored)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package ingest
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Storage/context"
+	"github.com/HolmesProcessing/Holmes-Storage/dataStorage"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// resultObject builds the object a totem result belongs to. Files are
+// identified by the sha256 sent along with the result, all other object
+// types are identified by the hashes of their normalized identifier.
+func resultObject(m *totemResult) (*dataStorage.Object, error) {
+	objType := strings.ToLower(m.ObjectType)
+	if objType == "" || objType == "sample" {
+		objType = "file"
+	}
+
+	if objType == "file" {
+		object := &dataStorage.Object{
+			Type:             objType,
+			CreationDateTime: time.Now(),
+			SHA256:           strings.ToLower(m.SHA256), //totem currently send the hash all upper case
+			SHA1:             strings.ToLower(m.SHA1),
+			MD5:              strings.ToLower(m.MD5),
+		}
+		if object.SHA256 == "" {
+			return nil, errors.New("Result for a file is missing the sha256")
+		}
+
+		return object, nil
+	}
+
+	if strings.TrimSpace(m.Identifier) == "" {
+		return nil, errors.New("Result for a " + objType + " is missing the identifier")
+	}
+
+	return NewObject(objType, m.Identifier, m.GenericType)
+}
+
+// NewObject builds a domain, ip, email or generic object from its
+// identifier. The identifier is normalized and split into its parts:
+// domains into the public suffix and the subdomain below the registered
+// domain, ips into v4 and v6 and emails into the local part, domain part
+// and sub-addressing. The object is identified by the hashes of its type
+// and normalized identifier, so e.g. a generic object can't collide with
+// a domain of the same name.
+func NewObject(objType, identifier, genericType string) (*dataStorage.Object, error) {
+	object := &dataStorage.Object{
+		Type:             objType,
+		CreationDateTime: time.Now(),
+	}
+
+	identifier = strings.TrimSpace(identifier)
+	if identifier == "" {
+		return nil, errors.New("Please supply the identifier of the " + objType)
+	}
+
+	switch objType {
+	case "domain":
+		identifier = strings.TrimSuffix(strings.ToLower(identifier), ".")
+		if err := checkDomain(identifier); err != nil {
+			return nil, err
+		}
+		object.DomainFQDN = identifier
+		object.DomainTLD, object.DomainSubDomain = splitDomain(identifier)
+
+	case "ip":
+		ip := net.ParseIP(identifier)
+		if ip == nil {
+			return nil, errors.New("Invalid ip address: " + identifier)
+		}
+		identifier = ip.String()
+		object.IPAddress = identifier
+		object.IPv6 = ip.To4() == nil
+
+	case "email":
+		identifier = strings.ToLower(identifier)
+		at := strings.LastIndex(identifier, "@")
+		if at < 1 || at == len(identifier)-1 {
+			return nil, errors.New("Invalid email address: " + identifier)
+		}
+		object.EmailAddress = identifier
+		object.EmailLocalPart = identifier[:at]
+		object.EmailDomainPart = identifier[at+1:]
+		if plus := strings.Index(object.EmailLocalPart, "+"); plus != -1 {
+			object.EmailSubAddressing = object.EmailLocalPart[plus+1:]
+		}
+
+	case "generic":
+		object.GenericIdentifier = identifier
+		object.GenericType = genericType
+
+	default:
+		return nil, errors.New("Unknown object type: " + objType)
+	}
+
+	key := objType + ":" + identifier
+	if objType == "generic" {
+		key = objType + ":" + genericType + ":" + identifier
+	}
+	object.MD5 = fmt.Sprintf("%x", md5.Sum([]byte(key)))
+	object.SHA1 = fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+	object.SHA256 = fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+
+	return object, nil
+}
+
+// checkDomain rejects names which can't be a domain. Names ending in a
+// numeric label, like ip addresses, are no domains either.
+func checkDomain(domain string) error {
+	if len(domain) > 253 {
+		return errors.New("Invalid domain: " + domain)
+	}
+
+	labels := strings.Split(domain, ".")
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || strings.ContainsAny(label, " \t/@:") {
+			return errors.New("Invalid domain: " + domain)
+		}
+	}
+
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return errors.New("Invalid domain, ip addresses are objects of type ip: " + domain)
+	}
+
+	return nil
+}
+
+// splitDomain returns the public suffix of a domain ("co.uk" for
+// "www.example.co.uk") and the subdomain below the registered domain
+// ("www"), which is empty for registered domains themselves.
+func splitDomain(domain string) (string, string) {
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+
+	registered, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil || registered == domain {
+		return suffix, ""
+	}
+
+	return suffix, strings.TrimSuffix(domain, "."+registered)
+}
+
+// ensureObject makes sure that a non-file object a result was sent for is
+// known to the database. Unknown objects are created on the fly together
+// with a submission recording the service that reported them.
+func ensureObject(c *context.Ctx, object *dataStorage.Object, serviceName string, m *totemResult) error {
+	_, err := c.Data.ObjectGet(object.SHA256)
+	if err == nil {
+		return nil
+	}
+	if err != dataStorage.ErrNotFound {
+		return err
+	}
+
+	c.Debug.Println("Creating unknown", object.Type, "object", object.SHA256)
+
+	submission := &dataStorage.Submission{
+		SHA256:   object.SHA256,
+		UserId:   "NotSend",
+		Source:   serviceName,
+		DateTime: time.Now(),
+		ObjName:  m.Identifier,
+		Tags:     m.Tags,
+		Comment:  "Created from a " + serviceName + " result",
+	}
+
+	if err = c.Data.SubmissionStore(submission); err != nil {
+		return err
+	}
+
+	if _, err = c.Data.ObjectStore(object); err != nil {
+		c.Data.SubmissionDelete(submission)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Storage/context"
+)
+
+// Replay re-ingests archived results from JSONL files, optionally gzip
+// compressed. Every line either holds a result in the same format as the
+// AMQP messages or an archived AMQP delivery of the form
+//
+//	{"routing_key": "peinfo.result.static.totem", "body": ...}
+//
+// where body is the message itself or a string containing it. The results
+// keep the time they were originally received, taken from the "timestamp"
+// of the delivery or else the modification time of the file.
+type Replay struct {
+	// DryRun only validates the results without storing them.
+	DryRun bool
+
+	// Rate limits the number of results handled per second, 0 means
+	// no limit.
+	Rate float64
+
+	// Progress is the interval between two progress reports.
+	Progress time.Duration
+
+	Read    int
+	Stored  int
+	Invalid int
+	Failed  int
+}
+
+type archivedDelivery struct {
+	RoutingKey string          `json:"routing_key"`
+	Timestamp  string          `json:"timestamp"` // RFC3339
+	Body       json.RawMessage `json:"body"`
+}
+
+// Run replays all given files in order. It only returns an error if a
+// file can't be read, failing results are counted and logged.
+func (r *Replay) Run(c *context.Ctx, paths []string) error {
+	if r.Progress <= 0 {
+		r.Progress = time.Second * 10
+	}
+
+	var throttle <-chan time.Time
+	if r.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / r.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	progress := time.NewTicker(r.Progress)
+	defer progress.Stop()
+
+	for _, path := range paths {
+		c.Info.Println("Replaying", path)
+
+		if err := r.replayFile(c, path, throttle, progress.C); err != nil {
+			return err
+		}
+	}
+
+	r.report(c)
+	return nil
+}
+
+func (r *Replay) replayFile(c *context.Ctx, path string, throttle, progress <-chan time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// detect gzip by its magic number instead of trusting the extension
+	in := bufio.NewReader(f)
+	var reader io.Reader = in
+	if magic, _ := in.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	// results can be far bigger than the default scanner buffer, so
+	// read whole lines instead
+	lines := bufio.NewReader(reader)
+	for lineNr := 1; ; lineNr++ {
+		line, err := lines.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if throttle != nil {
+				<-throttle
+			}
+
+			r.replayLine(c, line, path, lineNr, info.ModTime())
+		}
+
+		select {
+		case <-progress:
+			r.report(c)
+		default:
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (r *Replay) replayLine(c *context.Ctx, line []byte, path string, lineNr int, archived time.Time) {
+	r.Read++
+
+	body, serviceName, received := unwrapDelivery(line)
+	if received.IsZero() {
+		received = archived
+	}
+
+	var err error
+	if r.DryRun {
+		_, err = Validate(body, serviceName)
+	} else {
+		_, err = handle(c, body, serviceName, received)
+	}
+
+	if err != nil {
+		if IsInvalid(err) {
+			r.Invalid++
+		} else {
+			r.Failed++
+		}
+		c.Warning.Printf("%s:%d: %s\n", path, lineNr, err.Error())
+		return
+	}
+
+	r.Stored++
+}
+
+// unwrapDelivery extracts the message body, the service name and the time
+// of the delivery from an archived AMQP delivery. Plain results are
+// returned unchanged with a zero time.
+func unwrapDelivery(line []byte) ([]byte, string, time.Time) {
+	d := &archivedDelivery{}
+	if err := json.Unmarshal(line, d); err != nil || len(d.Body) == 0 {
+		return line, "", time.Time{}
+	}
+
+	body := []byte(d.Body)
+	var s string
+	if json.Unmarshal(d.Body, &s) == nil {
+		body = []byte(s)
+	}
+
+	// a malformed timestamp falls back to the time of the file
+	timestamp, _ := time.Parse(time.RFC3339Nano, d.Timestamp)
+
+	return body, strings.SplitN(d.RoutingKey, ".", 2)[0], timestamp
+}
+
+func (r *Replay) report(c *context.Ctx) {
+	verb := "stored"
+	if r.DryRun {
+		verb = "valid"
+	}
+
+	c.Info.Printf("Replayed %d results: %d %s, %d invalid, %d failed\n", r.Read, r.Stored, verb, r.Invalid, r.Failed)
+}
@@ -0,0 +1,104 @@
+package ingest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Storage/context"
+)
+
+// Spool is an ingestion source watching a directory for result files.
+// Every *.json file dropped into Dir has to contain exactly one result
+// in the same format as the AMQP messages. Writers should create the
+// file under a different name and rename it once it is complete.
+//
+// Stored results are deleted, invalid ones are moved to the "failed"
+// subdirectory and results which couldn't be stored because of a
+// temporary error are buffered like the other sources or, without a
+// Buffer, retried on the next scan.
+type Spool struct {
+	Dir      string
+	Interval time.Duration
+}
+
+func (s *Spool) Name() string {
+	return "spool"
+}
+
+// Ping checks that the spool directory exists.
+func (s *Spool) Ping() error {
+	info, err := os.Stat(s.Dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(s.Dir + " is not a directory")
+	}
+
+	return nil
+}
+
+func (s *Spool) Run(c *context.Ctx) error {
+	if s.Dir == "" {
+		return errors.New("Please supply a spool directory!")
+	}
+	if s.Interval <= 0 {
+		s.Interval = time.Second * 5
+	}
+
+	failedDir := filepath.Join(s.Dir, "failed")
+	if err := os.MkdirAll(failedDir, 0700); err != nil {
+		return err
+	}
+
+	for {
+		files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+		if err != nil {
+			return err
+		}
+
+		// handle the oldest files first, the glob is sorted by name
+		// which is good enough for time prefixed file names
+		sort.Strings(files)
+		for _, f := range files {
+			// the storage can start failing in the middle of a scan
+			Pressure.Wait()
+			s.handleFile(c, f, failedDir)
+		}
+
+		time.Sleep(s.Interval)
+	}
+}
+
+func (s *Spool) handleFile(c *context.Ctx, path string, failedDir string) {
+	c.Info.Println("Received new spool file", filepath.Base(path))
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.Warning.Println("Failed to read spool file:", err.Error())
+		return
+	}
+
+	// the service name is taken from the result itself
+	_, err = Accept(c, body, "")
+	if err != nil {
+		c.Warning.Println(err.Error(), "File:", filepath.Base(path))
+
+		if IsInvalid(err) {
+			if err = os.Rename(path, filepath.Join(failedDir, filepath.Base(path))); err != nil {
+				c.Warning.Println("Failed to move invalid spool file:", err.Error())
+			}
+		}
+		return
+	}
+
+	if err = os.Remove(path); err != nil {
+		c.Warning.Println("Failed to remove spool file:", err.Error())
+	}
+
+	c.Debug.Println("Spool file saved successfully!")
+}
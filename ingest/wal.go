@@ -0,0 +1,434 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HolmesProcessing/Holmes-Storage/context"
+)
+
+// WAL is a write-ahead buffer on local disk. Results which can't be stored
+// because the storage is failing are appended to it and acknowledged as
+// soon as they are synced to disk. A background flusher stores them once
+// the storage recovers.
+//
+// The buffer consists of numbered segment files, every record in them is
+// prefixed by its length and crc32 checksum. Records torn by a crash are
+// detected by the checksum and ignored. A checkpoint file remembers how far
+// the oldest segment was flushed, so after a crash at most the record which
+// was being flushed is stored twice.
+type WAL struct {
+	Dir string
+
+	// MaxBytes limits the disk space used by the buffer, 0 means no limit.
+	MaxBytes int64
+
+	// SegmentBytes is the size after which a new segment is started.
+	SegmentBytes int64
+
+	// FlushInterval is the time between two attempts to flush the buffer.
+	FlushInterval time.Duration
+
+	lock       sync.Mutex
+	active     *os.File
+	activeSeq  uint64
+	activeSize int64
+	segments   int
+	bytes      int64
+	full       bool
+	pending    int
+	flushed    int
+}
+
+type walRecord struct {
+	ServiceName string    `json:"service_name"`
+	Received    time.Time `json:"received"`
+	Body        []byte    `json:"body"`
+}
+
+// WALStatus reports the usage of the buffer.
+type WALStatus struct {
+	Segments int   `json:"segments"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"max_bytes"`
+	Pending  int   `json:"pending"`
+	Flushed  int   `json:"flushed"`
+}
+
+const walHeaderSize = 8 // record length and crc32, both uint32
+
+// Buffer is used by Accept if it is set.
+var Buffer *WAL
+
+// Open prepares the buffer directory and recovers the records left by a
+// previous run. New records always go to a fresh segment.
+func (w *WAL) Open() error {
+	if w.Dir == "" {
+		return errors.New("Please supply a directory for the write-ahead buffer!")
+	}
+	if w.SegmentBytes <= 0 {
+		w.SegmentBytes = 64 * 1024 * 1024
+	}
+	if w.FlushInterval <= 0 {
+		w.FlushInterval = time.Second * 10
+	}
+
+	if err := os.MkdirAll(w.Dir, 0700); err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	seqs, err := w.segmentSeqs()
+	if err != nil {
+		return err
+	}
+
+	// never reuse the number of a segment the checkpoint refers to
+	ckSeq, ckOffset := w.readCheckpoint()
+	w.activeSeq = ckSeq + 1
+
+	for _, seq := range seqs {
+		info, err := os.Stat(w.segmentPath(seq))
+		if err != nil {
+			return err
+		}
+		w.bytes += info.Size()
+
+		offset := int64(0)
+		if seq == ckSeq {
+			offset = ckOffset
+		}
+		err = w.readRecords(seq, offset, func(*walRecord, int64) error {
+			w.pending++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if seq >= w.activeSeq {
+			w.activeSeq = seq + 1
+		}
+	}
+	w.segments = len(seqs)
+
+	return nil
+}
+
+// Append writes a result to the buffer and returns once it is on disk.
+func (w *WAL) Append(body []byte, serviceName string, received time.Time) error {
+	payload, err := json.Marshal(&walRecord{
+		ServiceName: serviceName,
+		Received:    received,
+		Body:        body,
+	})
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.MaxBytes > 0 && w.bytes+int64(len(record)) > w.MaxBytes {
+		// the sources pause until a flush made room again
+		w.full = true
+		return errors.New("Write-ahead buffer is full")
+	}
+
+	if w.active == nil {
+		if err = w.openSegment(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.active.Write(record)
+	if err == nil {
+		err = w.active.Sync()
+	}
+	if err != nil {
+		// cut the torn record off, otherwise every record appended after
+		// it would be lost behind it when reading the segment
+		if w.active.Truncate(w.activeSize) != nil {
+			// at least keep the next records out of this segment
+			w.bytes += int64(n)
+			w.closeSegment()
+		}
+		return err
+	}
+
+	w.activeSize += int64(len(record))
+	w.bytes += int64(len(record))
+	w.pending++
+
+	if w.activeSize >= w.SegmentBytes {
+		w.closeSegment()
+	}
+
+	return nil
+}
+
+// Full reports whether the buffer reached its size limit or the last
+// record didn't fit anymore.
+func (w *WAL) Full() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.full || w.MaxBytes > 0 && w.bytes >= w.MaxBytes
+}
+
+// Status returns the current usage of the buffer.
+func (w *WAL) Status() *WALStatus {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return &WALStatus{
+		Segments: w.segments,
+		Bytes:    w.bytes,
+		MaxBytes: w.MaxBytes,
+		Pending:  w.pending,
+		Flushed:  w.flushed,
+	}
+}
+
+// Run flushes the buffer whenever the storage isn't paused.
+func (w *WAL) Run(c *context.Ctx) {
+	for {
+		time.Sleep(w.FlushInterval)
+
+		if Pressure.State() == StatePaused || w.Status().Pending == 0 {
+			continue
+		}
+
+		if err := w.Flush(c); err != nil {
+			c.Warning.Println("Flushing the write-ahead buffer stopped:", err.Error())
+		}
+	}
+}
+
+// Flush stores all buffered results, oldest first. It stops at the first
+// result which can't be stored and continues there on the next call.
+func (w *WAL) Flush(c *context.Ctx) error {
+	// seal the active segment, so every segment we read is complete
+	w.lock.Lock()
+	w.closeSegment()
+	seqs, err := w.segmentSeqs()
+	w.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ckSeq, ckOffset := w.readCheckpoint()
+	for _, seq := range seqs {
+		offset := int64(0)
+		if seq == ckSeq {
+			offset = ckOffset
+		}
+
+		err = w.readRecords(seq, offset, func(rec *walRecord, next int64) error {
+			_, err := handle(c, rec.Body, rec.ServiceName, rec.Received)
+			if err != nil && !IsInvalid(err) {
+				return err
+			}
+			if err != nil {
+				c.Warning.Println("Dropping invalid buffered result:", err.Error())
+			}
+
+			if err = w.writeCheckpoint(seq, next); err != nil {
+				return err
+			}
+
+			w.lock.Lock()
+			w.pending--
+			w.flushed++
+			w.lock.Unlock()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Stat(w.segmentPath(seq))
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(w.segmentPath(seq)); err != nil {
+			return err
+		}
+
+		w.lock.Lock()
+		w.segments--
+		w.bytes -= info.Size()
+		w.full = false
+		w.lock.Unlock()
+
+		c.Debug.Println("Flushed write-ahead segment", seq)
+	}
+
+	return nil
+}
+
+// openSegment has to be called with the lock held.
+func (w *WAL) openSegment() error {
+	f, err := os.OpenFile(w.segmentPath(w.activeSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	// make sure the new file survives a crash
+	if err = syncDir(w.Dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	w.active = f
+	w.activeSize = 0
+	w.segments++
+	return nil
+}
+
+// closeSegment has to be called with the lock held.
+func (w *WAL) closeSegment() {
+	if w.active == nil {
+		return
+	}
+
+	w.active.Close()
+	w.active = nil
+	w.activeSeq++
+}
+
+// readRecords calls fn for every intact record of a segment, starting at
+// offset. fn gets the offset right after the record. Reading stops at the
+// first torn or corrupt record, which can only be the result of a crash
+// while appending.
+func (w *WAL) readRecords(seq uint64, offset int64, fn func(*walRecord, int64) error) error {
+	f, err := os.Open(w.segmentPath(seq))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err = io.ReadFull(f, header); err != nil {
+			return nil
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err = io.ReadFull(f, payload); err != nil {
+			return nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return nil
+		}
+
+		rec := &walRecord{}
+		if err = json.Unmarshal(payload, rec); err != nil {
+			return nil
+		}
+
+		offset += int64(walHeaderSize + len(payload))
+		if err = fn(rec, offset); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *WAL) segmentPath(seq uint64) string {
+	return filepath.Join(w.Dir, fmt.Sprintf("%020d.wal", seq))
+}
+
+// segmentSeqs returns the numbers of all segments in ascending order.
+func (w *WAL) segmentSeqs() ([]uint64, error) {
+	files, err := filepath.Glob(filepath.Join(w.Dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]uint64, 0, len(files))
+	for _, f := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(f), ".wal"), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// readCheckpoint returns the segment and offset up to which the buffer was
+// flushed. A missing or broken checkpoint means nothing was flushed.
+func (w *WAL) readCheckpoint() (uint64, int64) {
+	data, err := ioutil.ReadFile(filepath.Join(w.Dir, "checkpoint"))
+	if err != nil {
+		return 0, 0
+	}
+
+	var (
+		seq    uint64
+		offset int64
+	)
+	if _, err = fmt.Sscanf(string(data), "%d %d", &seq, &offset); err != nil {
+		return 0, 0
+	}
+
+	return seq, offset
+}
+
+// writeCheckpoint atomically replaces the checkpoint.
+func (w *WAL) writeCheckpoint(seq uint64, offset int64) error {
+	tmp := filepath.Join(w.Dir, "checkpoint.tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprintf(f, "%d %d", seq, offset); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, filepath.Join(w.Dir, "checkpoint")); err != nil {
+		return err
+	}
+
+	return syncDir(w.Dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,95 @@
+package ingest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWALRecovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		tail    func(segment []byte) []byte
+		pending int
+	}{
+		{"intact", func(s []byte) []byte { return s }, 3},
+		{"torn header", func(s []byte) []byte { return append(s, 0, 0, 0) }, 3},
+		{"torn payload", func(s []byte) []byte { return s[:len(s)-1] }, 2},
+		{"corrupt payload", func(s []byte) []byte {
+			s[len(s)-2] ^= 0xff
+			return s
+		}, 2},
+		{"corrupt first record", func(s []byte) []byte {
+			s[walHeaderSize] ^= 0xff
+			return s
+		}, 0},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		w := &WAL{Dir: dir}
+		if err = w.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if err = w.Append([]byte(`{"result":"ok"}`), "service", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		path := w.segmentPath(w.activeSeq)
+		w.lock.Lock()
+		w.closeSegment()
+		w.lock.Unlock()
+
+		segment, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, test.tail(segment), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		recovered := &WAL{Dir: dir}
+		if err = recovered.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if pending := recovered.Status().Pending; pending != test.pending {
+			t.Errorf("%s: recovered %d records, want %d", test.name, pending, test.pending)
+		}
+	}
+}
+
+func TestWALFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := &WAL{Dir: dir, MaxBytes: 200}
+	if err = w.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"result":"ok"}`)
+	if err = w.Append(body, "service", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if w.Full() {
+		t.Fatal("buffer is full after the first record")
+	}
+
+	// the second record doesn't fit, the buffer has to report it
+	if err = w.Append(body, "service", time.Now()); err == nil {
+		t.Fatal("second record was appended beyond the limit")
+	}
+	if !w.Full() {
+		t.Error("buffer rejected a record but isn't full")
+	}
+}
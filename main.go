@@ -2,24 +2,55 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/HolmesProcessing/Holmes-Storage/amqp"
+	"github.com/HolmesProcessing/Holmes-Storage/archive"
 	"github.com/HolmesProcessing/Holmes-Storage/context"
 	"github.com/HolmesProcessing/Holmes-Storage/http"
+	"github.com/HolmesProcessing/Holmes-Storage/ingest"
+	"github.com/HolmesProcessing/Holmes-Storage/objectStorage"
 )
 
 func main() {
 	var (
 		setup    bool
 		objSetup bool
+		migrate  bool
+		status   bool
 		confPath string
+		replay   bool
+		dryRun   bool
+		rate     float64
+		rewrap   bool
+		repair   bool
+		scrub    bool
+		export   string
+		filter   string
+		format   string
+		tier     bool
 	)
 
 	flag.BoolVar(&setup, "setup", false, "Setup the Database")
 	flag.BoolVar(&objSetup, "objSetup", false, "Setup the object storage")
+	flag.BoolVar(&migrate, "migrate", false, "Apply the pending migrations of the Database and exit")
+	flag.BoolVar(&status, "migrate-status", false, "Print the applied and pending migrations of the Database and exit")
 	flag.StringVar(&confPath, "config", "", "Path to the config file")
+	flag.BoolVar(&replay, "replay", false, "Re-ingest the results from the JSONL (or gzipped JSONL) files given as arguments and exit")
+	flag.BoolVar(&dryRun, "dryRun", false, "Only validate the results when replaying, only print the CQL of pending migrations with -migrate")
+	flag.Float64Var(&rate, "rate", 0, "Maximum number of results replayed per second (0 = unlimited)")
+	flag.BoolVar(&rewrap, "rewrap", false, "Move all samples to the current encryption key and exit")
+	flag.BoolVar(&repair, "repair", false, "Copy samples missing on an object storage replica from the other replicas and exit")
+	flag.BoolVar(&scrub, "scrub", false, "Check the hashes of all stored samples and exit")
+	flag.StringVar(&export, "export", "", "Write the samples given as arguments (\"-\" reads them from stdin) or selected by -filter to this archive and exit")
+	flag.StringVar(&filter, "filter", "", "Select the exported samples by a query like \"source=feed&mime=application/x-dosexec&limit=100\"")
+	flag.StringVar(&format, "format", "tar", "Format of the exported archive: tar, tar.gz or zip")
+	flag.BoolVar(&tier, "tier", false, "Move the samples which weren't read for TieringMaxIdle days to the cold object storage and exit")
 	flag.Parse()
 
 	// load config
@@ -28,7 +59,8 @@ func main() {
 		confPath += "/config/storage.conf"
 	}
 
-	ctx := &context.Ctx{}
+	// maintenance reads every sample, which mustn't keep them all hot
+	ctx := &context.Ctx{Maintenance: rewrap || repair || scrub}
 	ctx.Initialize(confPath)
 
 	ctx.Debug.Println("Initialization finished")
@@ -51,8 +83,269 @@ func main() {
 		}
 	}
 
+	if status {
+		migrations, err := ctx.Data.MigrationStatus()
+		if err != nil {
+			ctx.Warning.Panicln("Reading the migrations failed:", err.Error())
+		}
+		for _, m := range migrations {
+			applied := "pending"
+			if !m.Applied.IsZero() {
+				applied = "applied " + m.Applied.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-50s %s\n", m.Version, m.Description, applied)
+		}
+		return
+	}
+
+	if migrate {
+		migrations, err := ctx.Data.Migrate(dryRun)
+		if err != nil {
+			ctx.Warning.Panicln("Migrating couldn't finish:", err.Error())
+		}
+		if dryRun {
+			for _, m := range migrations {
+				fmt.Printf("-- %d: %s\n", m.Version, m.Description)
+				for _, stmt := range m.Statements {
+					fmt.Println(stmt)
+				}
+			}
+			return
+		}
+		ctx.Info.Println("Applied", len(migrations), "migrations")
+		return
+	}
+
 	ctx.Info.Println("Initialization complete")
 
+	var tiered *objectStorage.Tiered
+	for _, layer := range objectStorage.Layers(ctx.Objects) {
+		if t, ok := layer.(*objectStorage.Tiered); ok {
+			tiered = t
+		}
+	}
+
+	if tier {
+		if tiered == nil {
+			ctx.Warning.Panicln("Tiering needs a ColdObjectStorage in the config")
+		}
+		if !tierSamples(ctx, tiered) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if rewrap {
+		var encrypted *objectStorage.Encrypted
+		for _, layer := range objectStorage.Layers(ctx.Objects) {
+			if e, ok := layer.(*objectStorage.Encrypted); ok {
+				encrypted = e
+			}
+		}
+		if encrypted == nil {
+			ctx.Warning.Panicln("Rewrapping needs encryption keys in the config")
+		}
+
+		rewrapped, failed, err := encrypted.Rewrap()
+		for id, err := range failed {
+			ctx.Warning.Println("Rewrapping", id, "failed:", err.Error())
+		}
+		if err != nil {
+			ctx.Warning.Panicln("Rewrap couldn't finish:", err.Error())
+		}
+
+		ctx.Info.Println("Rewrapped", rewrapped, "samples,", len(failed), "failed")
+		if len(failed) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if repair {
+		var replicated *objectStorage.Replicated
+		for _, layer := range objectStorage.Layers(ctx.Objects) {
+			if r, ok := layer.(*objectStorage.Replicated); ok {
+				replicated = r
+			}
+		}
+		if replicated == nil {
+			ctx.Warning.Panicln("Repairing needs ObjectStorageReplication in the config")
+		}
+
+		copied, failed, err := replicated.Repair()
+		for id, err := range failed {
+			ctx.Warning.Println("Repairing", id, "failed:", err.Error())
+		}
+		if err != nil {
+			ctx.Warning.Panicln("Repair couldn't finish:", err.Error())
+		}
+
+		ctx.Info.Println("Copied", copied, "samples,", len(failed), "failed")
+		if len(failed) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if scrub {
+		verified := ctx.Objects.(*objectStorage.Verified)
+
+		checked, failed, err := verified.Scrub()
+		for _, err := range failed {
+			ctx.Warning.Println(err.Error())
+		}
+		if err != nil {
+			ctx.Warning.Panicln("Scrub couldn't finish:", err.Error())
+		}
+
+		ctx.Info.Println("Checked", checked, "samples,", len(failed), "corrupt or mismatched")
+		if len(failed) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if export != "" {
+		if err := exportSamples(ctx, export, filter, format); err != nil {
+			ctx.Warning.Panicln("Export couldn't finish:", err.Error())
+		}
+		return
+	}
+
+	if replay {
+		r := &ingest.Replay{
+			DryRun: dryRun,
+			Rate:   rate,
+		}
+		if err := r.Run(ctx, flag.Args()); err != nil {
+			ctx.Warning.Panicln("Replay couldn't finish:", err.Error())
+		}
+		if r.Invalid > 0 || r.Failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if ctx.Config.WALDir != "" {
+		ingest.Buffer = &ingest.WAL{
+			Dir:           ctx.Config.WALDir,
+			MaxBytes:      ctx.Config.WALMaxSize * 1024 * 1024,
+			FlushInterval: time.Duration(ctx.Config.WALFlushInterval) * time.Second,
+		}
+		if err := ingest.Buffer.Open(); err != nil {
+			ctx.Warning.Panicln("Opening the write-ahead buffer failed:", err.Error())
+		}
+		ctx.Info.Println("Write-ahead buffer holds", ingest.Buffer.Status().Pending, "results")
+	}
+
+	var rpc *amqp.RPCServer
+	if ctx.Config.RPCQueue != "" {
+		rpc = &amqp.RPCServer{}
+		http.AddReadyCheck("amqp_rpc", rpc.Ping)
+	}
+
 	go http.Start(ctx)
-	amqp.Start(ctx)
+	if tiered != nil && ctx.Config.TieringInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Duration(ctx.Config.TieringInterval) * time.Hour)
+				tierSamples(ctx, tiered)
+			}
+		}()
+	}
+	if rpc != nil {
+		go func() {
+			ctx.Warning.Panicln("AMQP RPC failed:", rpc.Serve(ctx).Error())
+		}()
+	}
+	ingest.Run(ctx, ingestSources(ctx))
+}
+
+// ingestSources builds the configured ingestion sources, AMQP is used
+// if none are configured.
+func ingestSources(ctx *context.Ctx) []ingest.Source {
+	names := ctx.Config.Ingest
+	if len(names) == 0 {
+		names = []string{"amqp"}
+	}
+
+	sources := make([]ingest.Source, len(names))
+	for i, name := range names {
+		switch name {
+		case "amqp":
+			sources[i] = &amqp.Consumer{}
+		case "spool":
+			sources[i] = &ingest.Spool{
+				Dir:      ctx.Config.SpoolDir,
+				Interval: time.Duration(ctx.Config.SpoolInterval) * time.Second,
+			}
+		default:
+			ctx.Warning.Panicln("Please supply a valid ingestion source:", name)
+		}
+	}
+
+	return sources
+}
+
+// tierSamples moves idle samples to the cold object storage and reports
+// whether all of them could be moved.
+func tierSamples(ctx *context.Ctx, tiered *objectStorage.Tiered) bool {
+	moved, failed, err := tiered.Tier()
+	for id, err := range failed {
+		ctx.Warning.Println("Moving", id, "to the cold object storage failed:", err.Error())
+	}
+	if err != nil {
+		ctx.Warning.Println("Tiering couldn't finish:", err.Error())
+		return false
+	}
+
+	ctx.Info.Println("Moved", moved, "samples to the cold object storage,", len(failed), "failed")
+	return len(failed) == 0
+}
+
+// exportSamples writes the samples given as arguments or selected by the
+// filter to the archive at path. It exits with 1 if a sample couldn't be
+// exported.
+func exportSamples(ctx *context.Ctx, path, filter, format string) error {
+	query, err := url.ParseQuery(filter)
+	if err != nil {
+		return err
+	}
+
+	ids := flag.Args()
+	if len(ids) == 1 && ids[0] == "-" {
+		stdin, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		ids = []string{string(stdin)}
+	}
+
+	ids, err = archive.Select(ctx, ids, query)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	e := &archive.Export{
+		Format:   format,
+		Password: ctx.Config.ArchivePassword,
+	}
+	if err = e.Run(ctx, f, ids); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	ctx.Info.Println("Exported", e.Exported, "samples,", e.Failed, "failed, see the manifest")
+	if e.Failed > 0 {
+		os.Exit(1)
+	}
+	return nil
 }
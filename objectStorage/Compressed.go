@@ -0,0 +1,159 @@
+package objectStorage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed wraps another Storage and compresses samples with Codec
+// (gzip or zstd) before handing them on. The codec is recorded in the
+// Encoding of the stored sample and reads are decompressed transparently.
+// Samples which don't shrink noticeably, like packed executables, are
+// stored uncompressed. Without a Codec samples are stored as they are,
+// but the ones compressed earlier can still be read.
+type Compressed struct {
+	Storage Storage
+	Codec   string
+
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// minSaving is the share of the size a sample has to shrink by to be
+// stored compressed.
+const minSaving = 0.1
+
+func (s *Compressed) Initialize(c []*Connector) error {
+	if s.Codec != "" && s.Codec != "gzip" && s.Codec != "zstd" {
+		return errors.New("Unknown sample compression: " + s.Codec)
+	}
+
+	var err error
+	if s.encoder, err = zstd.NewWriter(nil); err != nil {
+		return err
+	}
+	if s.decoder, err = zstd.NewReader(nil); err != nil {
+		return err
+	}
+
+	return s.Storage.Initialize(c)
+}
+
+func (s *Compressed) Unwrap() Storage {
+	return s.Storage
+}
+
+func (s *Compressed) Setup() error {
+	return s.Storage.Setup()
+}
+
+func (s *Compressed) Ping() error {
+	return s.Storage.Ping()
+}
+
+func (s *Compressed) SampleStore(sample *Sample) error {
+	if s.Codec == "" {
+		return s.Storage.SampleStore(sample)
+	}
+
+	data, err := s.compress(s.Codec, sample.Data)
+	if err != nil {
+		return err
+	}
+
+	if float64(len(data)) > float64(len(sample.Data))*(1-minSaving) {
+		return s.Storage.SampleStore(sample)
+	}
+
+	return s.Storage.SampleStore(&Sample{
+		SHA256:   sample.SHA256,
+		Data:     data,
+		Encoding: s.Codec,
+		Size:     int64(len(sample.Data)),
+		Type:     sample.Type,
+	})
+}
+
+func (s *Compressed) SampleGet(id string) (*Sample, error) {
+	sample, err := s.Storage.SampleGet(id)
+	if err != nil {
+		return sample, err
+	}
+
+	return sample, s.decode(id, sample)
+}
+
+// decode decompresses a sample read from the wrapped storage.
+func (s *Compressed) decode(id string, sample *Sample) error {
+	if sample.Encoding == "" {
+		return nil
+	}
+
+	data, err := s.decompress(sample.Encoding, sample.Data)
+	if err != nil {
+		return errors.New("Decompressing sample " + id + " failed: " + err.Error())
+	}
+	sample.Data = data
+	sample.Encoding = ""
+
+	return nil
+}
+
+// SampleGetEncoded returns a sample the way it is stored, the Encoding of
+// the returned sample tells if and how it is compressed.
+func (s *Compressed) SampleGetEncoded(id string) (*Sample, error) {
+	return s.Storage.SampleGet(id)
+}
+
+func (s *Compressed) SampleDelete(sample *Sample) error {
+	return s.Storage.SampleDelete(sample)
+}
+
+func (s *Compressed) SampleStat(id string) (*SampleInfo, error) {
+	return s.Storage.SampleStat(id)
+}
+
+func (s *Compressed) SampleWalk(fn func(string) error) error {
+	return s.Storage.SampleWalk(fn)
+}
+
+func (s *Compressed) compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "zstd":
+		return s.encoder.EncodeAll(data, nil), nil
+
+	case "gzip":
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	return nil, errors.New("Unknown sample compression: " + codec)
+}
+
+func (s *Compressed) decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "zstd":
+		return s.decoder.DecodeAll(data, nil)
+
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	}
+
+	return nil, errors.New("Unknown sample compression: " + codec)
+}
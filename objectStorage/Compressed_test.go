@@ -0,0 +1,112 @@
+package objectStorage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func newCompressed(t *testing.T, s Storage, codec string) *Compressed {
+	c := &Compressed{Storage: s, Codec: codec}
+	if err := c.Initialize(nil); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	compressible := bytes.Repeat([]byte("MZ\x90\x00 this program cannot be run in DOS mode "), 100)
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		codec    string
+		data     []byte
+		encoding string
+	}{
+		{"gzip", compressible, "gzip"},
+		{"zstd", compressible, "zstd"},
+		{"gzip", random, ""},
+		{"zstd", random, ""},
+		{"", compressible, ""},
+	}
+
+	for _, test := range tests {
+		mem := newMemStorage()
+		c := newCompressed(t, mem, test.codec)
+		if err := c.SampleStore(&Sample{SHA256: sampleA, Data: test.data}); err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := c.SampleGetEncoded(sampleA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Encoding != test.encoding {
+			t.Errorf("%s: stored with encoding %q, expected %q", test.codec, stored.Encoding, test.encoding)
+		}
+		if test.encoding != "" && len(stored.Data) >= len(test.data) {
+			t.Errorf("%s: stored %d bytes of %d", test.codec, len(stored.Data), len(test.data))
+		}
+
+		sample, err := c.SampleGet(sampleA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sample.Data, test.data) {
+			t.Errorf("%s: read sample differs", test.codec)
+		}
+		if sample.Encoding != "" {
+			t.Errorf("%s: read sample has encoding %q", test.codec, sample.Encoding)
+		}
+	}
+}
+
+func TestCompressedTurnedOff(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible "), 100)
+
+	for _, codec := range []string{"gzip", "zstd"} {
+		mem := newMemStorage()
+		if err := newCompressed(t, mem, codec).SampleStore(&Sample{SHA256: sampleA, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+
+		off := newCompressed(t, mem, "")
+		sample, err := off.SampleGet(sampleA)
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if !bytes.Equal(sample.Data, data) {
+			t.Errorf("%s: sample differs after turning compression off", codec)
+		}
+
+		if err = off.SampleStore(&Sample{SHA256: sampleB, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(mem.raw(sampleB), data) {
+			t.Errorf("%s: new sample was compressed after turning compression off", codec)
+		}
+	}
+}
+
+func TestCompressedCorrupt(t *testing.T) {
+	mem := newMemStorage()
+	c := newCompressed(t, mem, "zstd")
+	if err := c.SampleStore(&Sample{SHA256: sampleA, Data: bytes.Repeat([]byte("a"), 1000)}); err != nil {
+		t.Fatal(err)
+	}
+
+	mem.setRaw(sampleA, []byte("not zstd"))
+	if _, err := c.SampleGet(sampleA); err == nil {
+		t.Error("corrupt sample was decompressed")
+	}
+}
+
+func TestCompressedUnknownCodec(t *testing.T) {
+	c := &Compressed{Storage: newMemStorage(), Codec: "lz4"}
+	if err := c.Initialize(nil); err == nil {
+		t.Error("unknown codec was accepted")
+	}
+}
@@ -0,0 +1,288 @@
+package objectStorage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Encrypted wraps another Storage and encrypts every sample with
+// AES-256-GCM before handing it on. Each sample gets its own random data
+// key, which is wrapped by a master key and stored in front of the
+// encrypted sample, so this works with every engine.
+//
+// Master keys are identified by an id. New samples are always wrapped
+// with the key KeyId, samples wrapped with another known key can still be
+// read and are moved to the current key by Rewrap.
+type Encrypted struct {
+	Storage Storage
+	KeyId   string
+
+	keys map[string][]byte
+}
+
+// encryptedMagic marks encrypted samples. Samples without it were stored
+// before encryption was enabled and are returned unchanged.
+var encryptedMagic = []byte("HOLMESENC1")
+
+// SetKeys decodes the base64 encoded 256 bit master keys, indexed by
+// their id.
+func (e *Encrypted) SetKeys(keys map[string]string) error {
+	e.keys = make(map[string][]byte, len(keys))
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return errors.New("Invalid master key id: " + id)
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return errors.New("Master key " + id + " is not base64 encoded: " + err.Error())
+		}
+		if len(raw) != 32 {
+			return errors.New("Master key " + id + " has to be 256 bit long")
+		}
+
+		e.keys[id] = raw
+	}
+
+	if _, ok := e.keys[e.KeyId]; !ok {
+		return errors.New("The current master key " + e.KeyId + " is unknown")
+	}
+
+	return nil
+}
+
+func (e *Encrypted) Initialize(c []*Connector) error {
+	return e.Storage.Initialize(c)
+}
+
+func (e *Encrypted) Unwrap() Storage {
+	return e.Storage
+}
+
+func (e *Encrypted) Setup() error {
+	return e.Storage.Setup()
+}
+
+func (e *Encrypted) Ping() error {
+	return e.Storage.Ping()
+}
+
+func (e *Encrypted) SampleStore(sample *Sample) error {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return err
+	}
+
+	// the sha256 is authenticated, so encrypted samples can't be swapped
+	ciphertext, err := seal(dataKey, sample.Data, []byte(sample.SHA256))
+	if err != nil {
+		return err
+	}
+
+	envelope, err := e.envelope(dataKey, ciphertext)
+	if err != nil {
+		return err
+	}
+
+	// the envelope is larger than the sample, so keep the original size
+	size := sample.Size
+	if size == 0 {
+		size = int64(len(sample.Data))
+	}
+
+	return e.Storage.SampleStore(&Sample{
+		SHA256:   sample.SHA256,
+		Data:     envelope,
+		Encoding: sample.Encoding,
+		Size:     size,
+		Type:     sample.Type,
+	})
+}
+
+func (e *Encrypted) SampleGet(id string) (*Sample, error) {
+	sample, err := e.Storage.SampleGet(id)
+	if err != nil {
+		return sample, err
+	}
+
+	return sample, e.decode(id, sample)
+}
+
+// decode decrypts a sample read from the wrapped storage.
+func (e *Encrypted) decode(id string, sample *Sample) error {
+	if !bytes.HasPrefix(sample.Data, encryptedMagic) {
+		return nil
+	}
+
+	keyId, dataKey, ciphertext, err := e.open(sample.Data)
+	if err != nil {
+		return err
+	}
+
+	data, err := unseal(dataKey, ciphertext, []byte(id))
+	if err != nil {
+		return errors.New("Decrypting sample " + id + " with data key wrapped by " + keyId + " failed: " + err.Error())
+	}
+	sample.Data = data
+
+	return nil
+}
+
+func (e *Encrypted) SampleDelete(sample *Sample) error {
+	return e.Storage.SampleDelete(sample)
+}
+
+func (e *Encrypted) SampleStat(id string) (*SampleInfo, error) {
+	return e.Storage.SampleStat(id)
+}
+
+func (e *Encrypted) SampleWalk(fn func(string) error) error {
+	return e.Storage.SampleWalk(fn)
+}
+
+// Rewrap moves all samples to the current master key. Only the data keys
+// are re-encrypted, samples stored before encryption was enabled are
+// encrypted. It returns the number of rewrapped samples and the errors of
+// the ones that failed.
+func (e *Encrypted) Rewrap() (int, map[string]error, error) {
+	rewrapped := 0
+	failed := make(map[string]error)
+
+	err := e.Storage.SampleWalk(func(id string) error {
+		done, err := e.rewrapSample(id)
+		if err != nil {
+			failed[id] = err
+		} else if done {
+			rewrapped++
+		}
+		return nil
+	})
+
+	return rewrapped, failed, err
+}
+
+func (e *Encrypted) rewrapSample(id string) (bool, error) {
+	sample, err := e.Storage.SampleGet(id)
+	if err != nil {
+		return false, err
+	}
+
+	if !bytes.HasPrefix(sample.Data, encryptedMagic) {
+		return true, e.SampleStore(sample)
+	}
+
+	keyId, dataKey, ciphertext, err := e.open(sample.Data)
+	if err != nil {
+		return false, err
+	}
+	if keyId == e.KeyId {
+		return false, nil
+	}
+
+	envelope, err := e.envelope(dataKey, ciphertext)
+	if err != nil {
+		return false, err
+	}
+
+	return true, e.Storage.SampleStore(&Sample{
+		SHA256:   id,
+		Data:     envelope,
+		Encoding: sample.Encoding,
+		Size:     sample.Size,
+		Type:     sample.Type,
+	})
+}
+
+// envelope wraps the data key with the current master key and builds
+//
+//	magic | len(key id) | key id | len(wrapped key) | wrapped key | ciphertext
+func (e *Encrypted) envelope(dataKey, ciphertext []byte) ([]byte, error) {
+	wrapped, err := seal(e.keys[e.KeyId], dataKey, []byte(e.KeyId))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(encryptedMagic)
+	buf.WriteByte(byte(len(e.KeyId)))
+	buf.WriteString(e.KeyId)
+	binary.Write(buf, binary.BigEndian, uint16(len(wrapped)))
+	buf.Write(wrapped)
+	buf.Write(ciphertext)
+
+	return buf.Bytes(), nil
+}
+
+// open parses an envelope and unwraps the data key.
+func (e *Encrypted) open(envelope []byte) (string, []byte, []byte, error) {
+	broken := errors.New("Encrypted sample is corrupt")
+
+	rest := envelope[len(encryptedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0])+2 {
+		return "", nil, nil, broken
+	}
+	keyId := string(rest[1 : 1+rest[0]])
+	rest = rest[1+int(rest[0]):]
+
+	l := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < l {
+		return "", nil, nil, broken
+	}
+
+	masterKey, ok := e.keys[keyId]
+	if !ok {
+		return "", nil, nil, errors.New("Sample is encrypted with the unknown master key " + keyId)
+	}
+
+	dataKey, err := unseal(masterKey, rest[:l], []byte(keyId))
+	if err != nil {
+		return "", nil, nil, errors.New("Unwrapping data key with " + keyId + " failed: " + err.Error())
+	}
+
+	return keyId, dataKey, rest[l:], nil
+}
+
+// seal encrypts with AES-GCM and prepends the random nonce.
+func seal(key, plaintext, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// unseal reverses seal.
+func unseal(key, ciphertext, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,171 @@
+package objectStorage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+const (
+	sampleA = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	sampleB = "fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func newEncrypted(t *testing.T, s Storage, keyId string, keys map[string]string) *Encrypted {
+	e := &Encrypted{Storage: s, KeyId: keyId}
+	if err := e.SetKeys(keys); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	mem := newMemStorage()
+	e := newEncrypted(t, mem, "k1", map[string]string{"k1": testKey(1)})
+
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	if err := e.SampleStore(&Sample{SHA256: sampleA, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := mem.raw(sampleA)
+	if !bytes.HasPrefix(raw, encryptedMagic) {
+		t.Error("stored sample isn't an envelope")
+	}
+	if bytes.Contains(raw, data) {
+		t.Error("stored sample contains the plaintext")
+	}
+	if !bytes.Contains(raw, []byte("k1")) {
+		t.Error("envelope doesn't name the master key")
+	}
+
+	sample, err := e.SampleGet(sampleA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sample.Data, data) {
+		t.Errorf("read %q, expected %q", sample.Data, data)
+	}
+	if sample.Size != int64(len(data)) {
+		t.Errorf("size is %d, expected %d", sample.Size, len(data))
+	}
+
+	// samples stored before encryption was enabled are passed through
+	mem.setRaw(sampleB, []byte("plain"))
+	if sample, err = e.SampleGet(sampleB); err != nil || string(sample.Data) != "plain" {
+		t.Errorf("read %q (%v), expected the unencrypted sample", sample.Data, err)
+	}
+}
+
+func TestEncryptedRejectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(envelope []byte) []byte
+		id     string
+	}{
+		{"ciphertext", func(env []byte) []byte {
+			env[len(env)-1] ^= 1
+			return env
+		}, sampleA},
+		{"wrapped data key", func(env []byte) []byte {
+			// magic | 1 | "k1" | 2 byte length | wrapped key
+			env[len(encryptedMagic)+1+2+2+20] ^= 1
+			return env
+		}, sampleA},
+		{"key id", func(env []byte) []byte {
+			// k1 -> k2, which is known, but didn't wrap the key
+			env[len(encryptedMagic)+2] = '2'
+			return env
+		}, sampleA},
+		{"truncated", func(env []byte) []byte {
+			return env[:len(encryptedMagic)+3]
+		}, sampleA},
+		// the sha256 is the additional data, so samples can't be swapped
+		{"other sample", func(env []byte) []byte { return env }, sampleB},
+	}
+
+	for _, test := range tests {
+		mem := newMemStorage()
+		e := newEncrypted(t, mem, "k1", map[string]string{"k1": testKey(1), "k2": testKey(2)})
+		if err := e.SampleStore(&Sample{SHA256: sampleA, Data: []byte("secret")}); err != nil {
+			t.Fatal(err)
+		}
+
+		mem.setRaw(test.id, test.tamper(mem.raw(sampleA)))
+		if sample, err := e.SampleGet(test.id); err == nil {
+			t.Errorf("%s: tampered sample was read as %q", test.name, sample.Data)
+		}
+	}
+}
+
+func TestEncryptedUnknownKey(t *testing.T) {
+	mem := newMemStorage()
+	e := newEncrypted(t, mem, "k1", map[string]string{"k1": testKey(1)})
+	if err := e.SampleStore(&Sample{SHA256: sampleA, Data: []byte("secret")}); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newEncrypted(t, mem, "k2", map[string]string{"k2": testKey(2)})
+	if _, err := other.SampleGet(sampleA); err == nil {
+		t.Error("sample was read without its master key")
+	}
+}
+
+func TestEncryptedRewrap(t *testing.T) {
+	mem := newMemStorage()
+	old := newEncrypted(t, mem, "old", map[string]string{"old": testKey(1)})
+	if err := old.SampleStore(&Sample{SHA256: sampleA, Data: []byte("sealed with the old key")}); err != nil {
+		t.Fatal(err)
+	}
+	mem.setRaw(sampleB, []byte("stored before encryption"))
+
+	e := newEncrypted(t, mem, "new", map[string]string{"old": testKey(1), "new": testKey(2)})
+
+	// still readable before the rewrap
+	sample, err := e.SampleGet(sampleA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sample.Data) != "sealed with the old key" {
+		t.Errorf("read %q before the rewrap", sample.Data)
+	}
+
+	rewrapped, failed, err := e.Rewrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatalf("rewrap failed: %v", failed)
+	}
+	if rewrapped != 2 {
+		t.Errorf("rewrapped %d samples, expected 2", rewrapped)
+	}
+
+	// nothing left to do
+	if rewrapped, _, _ = e.Rewrap(); rewrapped != 0 {
+		t.Errorf("rewrapped %d samples again", rewrapped)
+	}
+
+	// the old key isn't needed anymore
+	current := newEncrypted(t, mem, "new", map[string]string{"new": testKey(2)})
+	for id, data := range map[string]string{
+		sampleA: "sealed with the old key",
+		sampleB: "stored before encryption",
+	} {
+		if !bytes.HasPrefix(mem.raw(id), encryptedMagic) {
+			t.Errorf("%s isn't encrypted after the rewrap", id)
+		}
+		sample, err := current.SampleGet(id)
+		if err != nil {
+			t.Errorf("%s: %v", id, err)
+			continue
+		}
+		if string(sample.Data) != data {
+			t.Errorf("%s: read %q, expected %q", id, sample.Data, data)
+		}
+	}
+}
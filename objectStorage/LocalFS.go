@@ -0,0 +1,252 @@
+package objectStorage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalFS stores samples as files below a directory on local disk. By
+// default the files are spread over two levels of subdirectories named
+// after the first bytes of the sha256, the encoding and original size of
+// compressed or encrypted samples are kept in a .meta file next to the
+// sample.
+type LocalFS struct {
+	Path string
+
+	layout *keyLayout
+}
+
+type localFSMeta struct {
+	Encoding string `json:"encoding"`
+	Size     int64  `json:"size"`
+}
+
+func (s *LocalFS) Initialize(c []*Connector) error {
+	if len(c) < 1 {
+		return errors.New("Supply at least one node to connect to!")
+	}
+
+	if c[0].Path == "" {
+		return errors.New("Please supply a path for the local-fs object storage!")
+	}
+
+	s.Path = c[0].Path
+
+	var err error
+	if s.layout, err = newKeyLayout(c[0].KeyLayout, "{sha256:2}/{sha256:2:4}/{sha256}"); err != nil {
+		return err
+	}
+
+	_, err = os.Stat(s.Path)
+	return err
+}
+
+func (s *LocalFS) Setup() error {
+	return os.MkdirAll(s.Path, 0700)
+}
+
+func (s *LocalFS) Ping() error {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(s.Path + " is not a directory")
+	}
+
+	return nil
+}
+
+func (s *LocalFS) SampleStore(sample *Sample) error {
+	if err := checkId(sample.SHA256); err != nil {
+		return err
+	}
+	path := s.path(s.layout.key(sample.Type, sample.SHA256))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	if sample.Encoding != "" || sample.Size != 0 {
+		meta, err := json.Marshal(&localFSMeta{
+			Encoding: sample.Encoding,
+			Size:     sample.Size,
+		})
+		if err != nil {
+			return err
+		}
+		if err = writeFileAtomic(path+".meta", meta); err != nil {
+			return err
+		}
+	} else if err := os.Remove(path + ".meta"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return writeFileAtomic(path, sample.Data)
+}
+
+func (s *LocalFS) SampleGet(id string) (*Sample, error) {
+	sample := &Sample{SHA256: id}
+
+	path, sampleType, err := s.find(id)
+	if err != nil {
+		return sample, err
+	}
+	sample.Type = sampleType
+
+	if sample.Data, err = ioutil.ReadFile(path); err != nil {
+		return sample, err
+	}
+
+	meta, err := readMeta(path)
+	if err != nil {
+		return sample, err
+	}
+	sample.Encoding = meta.Encoding
+	sample.Size = meta.Size
+
+	return sample, nil
+}
+
+func (s *LocalFS) SampleStat(id string) (*SampleInfo, error) {
+	info := &SampleInfo{SHA256: id}
+
+	path, _, err := s.find(id)
+	if os.IsNotExist(err) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return info, err
+	}
+
+	meta, err := readMeta(path)
+	if err != nil {
+		return info, err
+	}
+
+	info.Exists = true
+	info.StoredSize = stat.Size()
+	info.Size = meta.Size
+	info.Encoding = meta.Encoding
+	info.Modified = stat.ModTime()
+	if info.Size == 0 {
+		info.Size = info.StoredSize
+	}
+
+	return info, nil
+}
+
+func (s *LocalFS) SampleDelete(sample *Sample) error {
+	if err := checkId(sample.SHA256); err != nil {
+		return err
+	}
+	path := s.path(s.layout.key(sample.Type, sample.SHA256))
+
+	if err := os.Remove(path + ".meta"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (s *LocalFS) SampleWalk(fn func(string) error) error {
+	return filepath.Walk(s.Path, func(path string, info os.FileInfo, err error) error {
+		// samples may be deleted while walking
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := info.Name()
+		if info.IsDir() || strings.Contains(name, ".") {
+			return nil
+		}
+
+		return fn(name)
+	})
+}
+
+// readMeta reads the .meta file of a sample, which only exists if the
+// sample was compressed or encrypted.
+func readMeta(path string) (*localFSMeta, error) {
+	meta := &localFSMeta{}
+
+	data, err := ioutil.ReadFile(path + ".meta")
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+
+	return meta, json.Unmarshal(data, meta)
+}
+
+// find returns the path and type of a stored sample. The type isn't
+// known when reading, so all places the sample could be are tried.
+func (s *LocalFS) find(id string) (string, string, error) {
+	if err := checkId(id); err != nil {
+		return "", "", err
+	}
+
+	var err error
+	for _, candidate := range s.layout.candidates(id) {
+		path := s.path(candidate.Key)
+		if _, err = os.Stat(path); err == nil {
+			return path, candidate.Type, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", "", err
+		}
+	}
+
+	return "", "", err
+}
+
+func (s *LocalFS) path(key string) string {
+	return filepath.Join(s.Path, filepath.FromSlash(key))
+}
+
+// checkId makes sure an id can't be used to escape the directory.
+func checkId(id string) error {
+	if len(id) < 4 || strings.ContainsAny(id, "./\\") {
+		return errors.New("Invalid sample id: " + id)
+	}
+
+	return nil
+}
+
+// writeFileAtomic makes sure a file is either completely written or not
+// at all, even if we crash in between.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,292 @@
+package objectStorage
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// Replicated keeps every sample on several independent backends, e.g. S3
+// buckets in two regions or S3 and local disk. Writes go to all backends
+// in parallel and succeed once WriteQuorum of them stored the sample,
+// reads try the backends in order until one of them answers. Samples
+// missing on a backend because of a failed write are copied over by
+// Repair.
+type Replicated struct {
+	Backends    []Storage
+	WriteQuorum int
+
+	// Check is set by Verified, it decodes a sample read from a backend
+	// and checks its hash, so a corrupt copy can be skipped for the one of
+	// the next backend.
+	Check func(id string, sample *Sample) error
+}
+
+// Initialize hands each backend the connector at its position.
+func (s *Replicated) Initialize(c []*Connector) error {
+	if len(c) != len(s.Backends) {
+		return errors.New("Every replicated object storage needs exactly one connector!")
+	}
+
+	if s.WriteQuorum <= 0 || s.WriteQuorum > len(s.Backends) {
+		s.WriteQuorum = len(s.Backends)
+	}
+
+	for i, backend := range s.Backends {
+		if err := backend.Initialize(c[i : i+1]); err != nil {
+			return errors.New("Replica " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *Replicated) Setup() error {
+	for i, backend := range s.Backends {
+		if err := backend.Setup(); err != nil {
+			return errors.New("Replica " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Ping fails if fewer than WriteQuorum backends are reachable, so no
+// sample could be stored.
+func (s *Replicated) Ping() error {
+	errs := s.each(func(backend Storage) error {
+		return backend.Ping()
+	})
+
+	reachable := 0
+	for _, err := range errs {
+		if err == nil {
+			reachable++
+		}
+	}
+
+	if reachable < s.WriteQuorum {
+		return errors.New("Only " + strconv.Itoa(reachable) + " of " + strconv.Itoa(s.WriteQuorum) + " required replicas reachable: " + firstError(errs).Error())
+	}
+
+	return nil
+}
+
+func (s *Replicated) SampleStore(sample *Sample) error {
+	errs := s.each(func(backend Storage) error {
+		return backend.SampleStore(sample)
+	})
+
+	stored := 0
+	for _, err := range errs {
+		if err == nil {
+			stored++
+		}
+	}
+
+	if stored < s.WriteQuorum {
+		return errors.New("Sample only stored on " + strconv.Itoa(stored) + " of " + strconv.Itoa(s.WriteQuorum) + " required replicas: " + firstError(errs).Error())
+	}
+
+	return nil
+}
+
+// SampleGet returns the sample of the first backend holding an intact
+// copy. If every copy fails the Check, the first one is returned and the
+// outer layers decide what to do with it.
+func (s *Replicated) SampleGet(id string) (*Sample, error) {
+	var (
+		sample  *Sample
+		err     error
+		corrupt *Sample
+	)
+
+	for _, backend := range s.Backends {
+		if sample, err = backend.SampleGet(id); err != nil {
+			continue
+		}
+		if s.Check == nil || s.Check(id, sample) == nil {
+			return sample, nil
+		}
+		if corrupt == nil {
+			corrupt = sample
+		}
+	}
+
+	if corrupt != nil {
+		return corrupt, nil
+	}
+	return sample, err
+}
+
+// SampleStat reports the sample of the first backend holding it and
+// marks it Incomplete if another backend lacks it or can't be asked.
+// Failing backends are only reported if no other backend holds the
+// sample.
+func (s *Replicated) SampleStat(id string) (*SampleInfo, error) {
+	infos := make([]*SampleInfo, len(s.Backends))
+	errs := make([]error, len(s.Backends))
+	for i, backend := range s.Backends {
+		infos[i], errs[i] = backend.SampleStat(id)
+	}
+
+	var found *SampleInfo
+	missing := false
+	for i, info := range infos {
+		if errs[i] != nil || !info.Exists {
+			missing = true
+			continue
+		}
+		if found == nil {
+			found = info
+		}
+	}
+
+	if found != nil {
+		found.Incomplete = missing
+		return found, nil
+	}
+	if err := firstError(errs); err != nil {
+		return &SampleInfo{SHA256: id}, err
+	}
+	return infos[0], nil
+}
+
+func (s *Replicated) SampleDelete(sample *Sample) error {
+	return firstError(s.each(func(backend Storage) error {
+		return backend.SampleDelete(sample)
+	}))
+}
+
+// SampleWalk visits every sample stored on any backend once. It has to
+// remember all visited ids to do so.
+func (s *Replicated) SampleWalk(fn func(string) error) error {
+	seen := make(map[string]bool)
+
+	for _, backend := range s.Backends {
+		err := backend.SampleWalk(func(id string) error {
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+
+			return fn(id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Repair copies samples which are missing on a backend from one of the
+// backends holding an intact copy. Copies failing the Check are skipped
+// for the one of the next backend. It returns the number of copied
+// samples and the errors of the samples which couldn't be repaired.
+func (s *Replicated) Repair() (int, map[string]error, error) {
+	// collect which samples every backend holds
+	stored := make([]map[string]bool, len(s.Backends))
+	for i, backend := range s.Backends {
+		stored[i] = make(map[string]bool)
+		err := backend.SampleWalk(func(id string) error {
+			stored[i][id] = true
+			return nil
+		})
+		if err != nil {
+			return 0, nil, errors.New("Replica " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+
+	ids := make(map[string]bool)
+	for i := range s.Backends {
+		for id := range stored[i] {
+			ids[id] = true
+		}
+	}
+
+	copied := 0
+	failed := make(map[string]error)
+
+	for id := range ids {
+		var missing []int
+		for j := range s.Backends {
+			if !stored[j][id] {
+				missing = append(missing, j)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		// fetch the sample once for all backends missing it
+		sample, err := s.intactCopy(id, stored)
+		if err != nil {
+			failed[id] = err
+			continue
+		}
+
+		for _, j := range missing {
+			if err := s.Backends[j].SampleStore(sample); err != nil {
+				failed[id] = errors.New("Replica " + strconv.Itoa(j) + ": " + err.Error())
+				continue
+			}
+			copied++
+		}
+	}
+
+	return copied, failed, nil
+}
+
+// intactCopy returns the copy of the first backend holding the sample
+// which can be read and passes the Check.
+func (s *Replicated) intactCopy(id string, stored []map[string]bool) (*Sample, error) {
+	var lastErr error
+
+	for i, backend := range s.Backends {
+		if !stored[i][id] {
+			continue
+		}
+
+		sample, err := backend.SampleGet(id)
+		if err == nil && s.Check != nil {
+			err = s.Check(id, sample)
+		}
+		if err != nil {
+			lastErr = errors.New("Replica " + strconv.Itoa(i) + ": " + err.Error())
+			continue
+		}
+
+		return sample, nil
+	}
+
+	return nil, errors.New("No intact copy left, last error: " + lastErr.Error())
+}
+
+// each runs fn for all backends in parallel and returns their errors in
+// the order of the backends.
+func (s *Replicated) each(fn func(Storage) error) []error {
+	errs := make([]error, len(s.Backends))
+
+	var wg sync.WaitGroup
+	for i, backend := range s.Backends {
+		wg.Add(1)
+		go func(i int, backend Storage) {
+			defer wg.Done()
+			errs[i] = fn(backend)
+		}(i, backend)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func firstError(errs []error) error {
+	for i, err := range errs {
+		if err != nil {
+			return errors.New("Replica " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
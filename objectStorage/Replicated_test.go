@@ -0,0 +1,166 @@
+package objectStorage
+
+import (
+	"testing"
+)
+
+// newReplicated returns a verified, replicated storage on n memory
+// backends, sampleA is "foo" and sampleB "bar".
+func newReplicated(t *testing.T, n, quorum int) (*Verified, *Replicated, []*memStorage) {
+	mems := make([]*memStorage, n)
+	backends := make([]Storage, n)
+	for i := range mems {
+		mems[i] = newMemStorage()
+		backends[i] = mems[i]
+	}
+
+	replicated := &Replicated{Backends: backends, WriteQuorum: quorum}
+	verified := &Verified{Storage: replicated, Mode: "fail"}
+	if err := verified.Initialize(make([]*Connector, n)); err != nil {
+		t.Fatal(err)
+	}
+
+	return verified, replicated, mems
+}
+
+func TestReplicatedWriteQuorum(t *testing.T) {
+	tests := []struct {
+		quorum int
+		down   int
+		ok     bool
+	}{
+		{0, 0, true},
+		{0, 1, false},
+		{2, 1, true},
+		{2, 2, false},
+	}
+
+	for _, test := range tests {
+		s, _, mems := newReplicated(t, 3, test.quorum)
+		for i := 0; i < test.down; i++ {
+			mems[i].setDown(true)
+		}
+
+		err := s.SampleStore(&Sample{SHA256: sampleA, Data: []byte("foo")})
+		if (err == nil) != test.ok {
+			t.Errorf("quorum %d with %d replicas down: got %v", test.quorum, test.down, err)
+		}
+		if pingErr := s.Ping(); (pingErr == nil) != test.ok {
+			t.Errorf("quorum %d with %d replicas down: ping got %v", test.quorum, test.down, pingErr)
+		}
+	}
+}
+
+func TestReplicatedSampleGet(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(mems []*memStorage)
+		ok    bool
+	}{
+		{"all intact", func(mems []*memStorage) {}, true},
+		{"first down", func(mems []*memStorage) { mems[0].setDown(true) }, true},
+		{"first missing", func(mems []*memStorage) { mems[0].SampleDelete(&Sample{SHA256: sampleA}) }, true},
+		{"first corrupt", func(mems []*memStorage) { mems[0].setRaw(sampleA, []byte("fo0")) }, true},
+		{"all corrupt", func(mems []*memStorage) {
+			mems[0].setRaw(sampleA, []byte("fo0"))
+			mems[1].setRaw(sampleA, []byte("f0o"))
+		}, false},
+	}
+
+	for _, test := range tests {
+		s, _, mems := newReplicated(t, 2, 0)
+		if err := s.SampleStore(&Sample{SHA256: sampleA, Data: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		}
+		test.setup(mems)
+
+		sample, err := s.SampleGet(sampleA)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: read corrupt sample %q", test.name, sample.Data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(sample.Data) != "foo" {
+			t.Errorf("%s: read %q", test.name, sample.Data)
+		}
+	}
+}
+
+func TestReplicatedSampleStat(t *testing.T) {
+	s, _, mems := newReplicated(t, 3, 1)
+
+	info, err := s.SampleStat(sampleA)
+	if err != nil || info.Exists {
+		t.Errorf("unknown sample: got %+v, %v", info, err)
+	}
+
+	mems[1].SampleStore(&Sample{SHA256: sampleA, Data: []byte("foo")})
+	info, err = s.SampleStat(sampleA)
+	if err != nil || !info.Exists || !info.Incomplete {
+		t.Errorf("sample on one replica: got %+v, %v", info, err)
+	}
+
+	// storing it again fills the gaps
+	if err = s.SampleStore(&Sample{SHA256: sampleA, Data: []byte("foo")}); err != nil {
+		t.Fatal(err)
+	}
+	info, err = s.SampleStat(sampleA)
+	if err != nil || !info.Exists || info.Incomplete {
+		t.Errorf("sample on all replicas: got %+v, %v", info, err)
+	}
+
+	mems[2].setDown(true)
+	info, err = s.SampleStat(sampleA)
+	if err != nil || !info.Exists || !info.Incomplete {
+		t.Errorf("sample with a replica down: got %+v, %v", info, err)
+	}
+}
+
+func TestReplicatedRepair(t *testing.T) {
+	tests := []struct {
+		name   string
+		copies []string // content on every replica, "" if missing
+		copied int
+		failed bool
+	}{
+		{"complete", []string{"foo", "foo", "foo"}, 0, false},
+		{"missing once", []string{"foo", "", "foo"}, 1, false},
+		{"missing twice", []string{"", "", "foo"}, 2, false},
+		{"first copy corrupt", []string{"fo0", "foo", ""}, 1, false},
+		{"all copies corrupt", []string{"fo0", "f0o", ""}, 0, true},
+	}
+
+	for _, test := range tests {
+		_, replicated, mems := newReplicated(t, len(test.copies), 1)
+		for i, data := range test.copies {
+			if data != "" {
+				mems[i].setRaw(sampleA, []byte(data))
+			}
+		}
+
+		copied, failed, err := replicated.Repair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied != test.copied {
+			t.Errorf("%s: copied %d samples, expected %d", test.name, copied, test.copied)
+		}
+		if (failed[sampleA] != nil) != test.failed {
+			t.Errorf("%s: got failures %v", test.name, failed)
+		}
+		if test.failed {
+			continue
+		}
+
+		for i, mem := range mems {
+			if test.copies[i] == "" && string(mem.raw(sampleA)) != "foo" {
+				t.Errorf("%s: replica %d holds %q after the repair", test.name, i, mem.raw(sampleA))
+			}
+		}
+	}
+}
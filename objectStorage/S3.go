@@ -5,8 +5,10 @@ import (
 	"errors"
 	"io/ioutil"
 	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	amazons3 "github.com/aws/aws-sdk-go/service/s3"
@@ -15,6 +17,8 @@ import (
 type S3 struct {
 	DB     *amazons3.S3
 	Bucket string
+
+	layout *keyLayout
 }
 
 func (s *S3) Initialize(c []*Connector) error {
@@ -40,6 +44,11 @@ func (s *S3) Initialize(c []*Connector) error {
 	s.DB = amazons3.New(s3sess)
 	s.Bucket = c[0].Bucket
 
+	// samples used to be stored at the root of the bucket
+	if s.layout, err = newKeyLayout(c[0].KeyLayout, "{sha256}"); err != nil {
+		return err
+	}
+
 	// since there is no definit way to test the connection
 	// we are just doint a dummy request here to see if the
 	// connection is stable
@@ -71,42 +80,174 @@ func (s *S3) Setup() error {
 	return nil
 }
 
-func (s *S3) SampleDelete(sample *Sample) error {
-	_, err := s.DB.DeleteObject(&amazons3.DeleteObjectInput{
+// Ping checks that the bucket exists and the credentials grant access.
+func (s *S3) Ping() error {
+	_, err := s.DB.HeadBucket(&amazons3.HeadBucketInput{
 		Bucket: &s.Bucket,
-		Key:    &sample.SHA256,
 	})
 
 	return err
 }
 
+func (s *S3) SampleDelete(sample *Sample) error {
+	keys := []string{s.layout.key(sample.Type, sample.SHA256)}
+	if s.layout.legacy != "" && (sample.Type == "" || sample.Type == "file") {
+		keys = append(keys, expand(s.layout.legacy, "file", sample.SHA256))
+	}
+
+	for _, key := range keys {
+		_, err := s.DB.DeleteObject(&amazons3.DeleteObjectInput{
+			Bucket: &s.Bucket,
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (s *S3) SampleStore(sample *Sample) error {
-	_, err := s.DB.PutObject(&amazons3.PutObjectInput{
+	input := &amazons3.PutObjectInput{
 		Body:   bytes.NewReader(sample.Data),
 		Bucket: &s.Bucket,
-		Key:    &sample.SHA256,
-	})
+		Key:    aws.String(s.layout.key(sample.Type, sample.SHA256)),
+	}
+
+	// the codec is kept in the user metadata instead of Content-Encoding,
+	// otherwise S3 clients would decompress the sample on their own
+	input.Metadata = map[string]*string{}
+	if sample.Encoding != "" {
+		input.Metadata["Encoding"] = aws.String(sample.Encoding)
+	}
+	if sample.Size != 0 {
+		input.Metadata["Size"] = aws.String(strconv.FormatInt(sample.Size, 10))
+	}
+
+	_, err := s.DB.PutObject(input)
 
 	return err
 }
 
 func (s *S3) SampleGet(id string) (*Sample, error) {
+	var (
+		resp *amazons3.GetObjectOutput
+		err  error
+	)
+
 	sample := &Sample{SHA256: id}
 
-	resp, err := s.DB.GetObject(&amazons3.GetObjectInput{
-		Bucket: &s.Bucket,
-		Key:    &id,
-	})
+	// the type isn't known, so try where the sample could be
+	for _, candidate := range s.layout.candidates(id) {
+		resp, err = s.DB.GetObject(&amazons3.GetObjectInput{
+			Bucket: &s.Bucket,
+			Key:    aws.String(candidate.Key),
+		})
+		if err == nil {
+			sample.Type = candidate.Type
+			break
+		}
+		if !isNotFound(err) {
+			return sample, err
+		}
+	}
 
 	if err != nil {
 		return sample, err
 	}
 
+	defer resp.Body.Close()
+
 	if sample.Data, err = ioutil.ReadAll(resp.Body); err != nil {
 		return sample, err
 	}
 
+	sample.Encoding = metadata(resp.Metadata, "Encoding")
+	sample.Size, _ = strconv.ParseInt(metadata(resp.Metadata, "Size"), 10, 64)
+
 	return sample, err
 }
 
+func (s *S3) SampleStat(id string) (*SampleInfo, error) {
+	var (
+		resp *amazons3.HeadObjectOutput
+		err  error
+	)
+
+	info := &SampleInfo{SHA256: id}
+
+	for _, candidate := range s.layout.candidates(id) {
+		resp, err = s.DB.HeadObject(&amazons3.HeadObjectInput{
+			Bucket: &s.Bucket,
+			Key:    aws.String(candidate.Key),
+		})
+		if err == nil {
+			break
+		}
+		if !isNotFound(err) {
+			return info, err
+		}
+	}
+
+	if err != nil {
+		return info, nil
+	}
+
+	info.Exists = true
+	info.StoredSize = aws.Int64Value(resp.ContentLength)
+	info.Modified = aws.TimeValue(resp.LastModified)
+	info.Encoding = metadata(resp.Metadata, "Encoding")
+
+	info.Size, err = strconv.ParseInt(metadata(resp.Metadata, "Size"), 10, 64)
+	if err != nil {
+		info.Size = info.StoredSize
+	}
+
+	return info, nil
+}
+
+func (s *S3) SampleWalk(fn func(string) error) error {
+	var walkErr error
+
+	err := s.DB.ListObjectsV2Pages(&amazons3.ListObjectsV2Input{
+		Bucket: &s.Bucket,
+	}, func(page *amazons3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if walkErr = fn(s.layout.sha256(*obj.Key)); walkErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
+
+func isNotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == amazons3.ErrCodeNoSuchKey {
+		return true
+	}
+
+	return false
+}
+
+// metadata looks up a user metadata entry, S3 implementations don't agree
+// on the case of the returned keys.
+func metadata(m map[string]*string, key string) string {
+	for k, v := range m {
+		if strings.EqualFold(k, key) && v != nil {
+			return *v
+		}
+	}
+
+	return ""
+}
+
 // TODO: Support MultipleObjects retrieval and getting. Useful when using something over 100megs
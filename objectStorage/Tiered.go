@@ -0,0 +1,221 @@
+package objectStorage
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Tiered keeps samples on a fast primary storage (Hot) and moves the ones
+// which weren't read for MaxIdle to a cheaper one (Cold). Reads fall
+// through to the cold storage, so moved samples stay available. The time
+// of the last read is recorded in Access, samples without one count as
+// read when they were stored.
+type Tiered struct {
+	Hot            Storage
+	Cold           Storage
+	ColdConnectors []*Connector
+	MaxIdle        time.Duration
+
+	// Access may be nil, e.g. for maintenance runs which read every
+	// sample and shouldn't count as access. It mustn't change after
+	// Initialize.
+	Access AccessLog
+
+	accessed chan string
+}
+
+// AccessLog remembers when samples were last read.
+type AccessLog interface {
+	SampleAccessStore(sha256 string, t time.Time) error
+
+	// returns the zero time if the sample was never read
+	SampleAccessGet(sha256 string) (time.Time, error)
+}
+
+func (s *Tiered) Initialize(c []*Connector) error {
+	if s.MaxIdle <= 0 {
+		return errors.New("Please supply the time after which samples move to the cold storage!")
+	}
+
+	if err := s.Hot.Initialize(c); err != nil {
+		return err
+	}
+	if err := s.Cold.Initialize(s.ColdConnectors); err != nil {
+		return errors.New("Cold storage: " + err.Error())
+	}
+
+	// reads are recorded in the background, they are only a hint
+	s.accessed = make(chan string, 1024)
+	go func() {
+		for id := range s.accessed {
+			if access := s.Access; access != nil {
+				access.SampleAccessStore(id, time.Now())
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *Tiered) Unwrap() Storage {
+	return s.Hot
+}
+
+func (s *Tiered) Setup() error {
+	if err := s.Hot.Setup(); err != nil {
+		return err
+	}
+	if err := s.Cold.Setup(); err != nil {
+		return errors.New("Cold storage: " + err.Error())
+	}
+
+	return nil
+}
+
+func (s *Tiered) Ping() error {
+	if err := s.Hot.Ping(); err != nil {
+		return err
+	}
+	if err := s.Cold.Ping(); err != nil {
+		return errors.New("Cold storage: " + err.Error())
+	}
+
+	return nil
+}
+
+// SampleStore stores new samples in the hot storage. Samples which
+// already moved to the cold storage, e.g. while rewrapping, are replaced
+// there.
+func (s *Tiered) SampleStore(sample *Sample) error {
+	info, err := s.Cold.SampleStat(sample.SHA256)
+	if err != nil {
+		return errors.New("Cold storage: " + err.Error())
+	}
+
+	if info.Exists {
+		return s.Cold.SampleStore(sample)
+	}
+	return s.Hot.SampleStore(sample)
+}
+
+func (s *Tiered) SampleGet(id string) (*Sample, error) {
+	sample, err := s.Hot.SampleGet(id)
+	if err != nil {
+		var coldErr error
+		if sample, coldErr = s.Cold.SampleGet(id); coldErr != nil {
+			return sample, err
+		}
+	}
+
+	if s.Access != nil {
+		select {
+		case s.accessed <- id:
+		default:
+		}
+	}
+
+	return sample, nil
+}
+
+func (s *Tiered) SampleDelete(sample *Sample) error {
+	if err := s.Hot.SampleDelete(sample); err != nil {
+		return err
+	}
+
+	return s.Cold.SampleDelete(sample)
+}
+
+func (s *Tiered) SampleStat(id string) (*SampleInfo, error) {
+	info, err := s.Hot.SampleStat(id)
+	if err != nil || info.Exists {
+		return info, err
+	}
+
+	return s.Cold.SampleStat(id)
+}
+
+// SampleWalk visits the samples of both storages. A sample can be in both
+// for a moment while it is moved, so it may be visited twice.
+func (s *Tiered) SampleWalk(fn func(string) error) error {
+	if err := s.Hot.SampleWalk(fn); err != nil {
+		return err
+	}
+
+	return s.Cold.SampleWalk(fn)
+}
+
+// Tier moves the samples which weren't read for MaxIdle to the cold
+// storage. It returns the number of moved samples and the errors of the
+// samples which couldn't be moved.
+func (s *Tiered) Tier() (int, map[string]error, error) {
+	moved := 0
+	failed := make(map[string]error)
+	cutoff := time.Now().Add(-s.MaxIdle)
+
+	err := s.Hot.SampleWalk(func(id string) error {
+		last, err := s.lastAccess(id)
+		if err != nil {
+			failed[id] = err
+			return nil
+		}
+		if last.After(cutoff) {
+			return nil
+		}
+
+		if err = s.move(id); err != nil {
+			failed[id] = err
+			return nil
+		}
+
+		moved++
+		return nil
+	})
+
+	return moved, failed, err
+}
+
+// lastAccess returns when a sample was last read, or stored if it was
+// never read.
+func (s *Tiered) lastAccess(id string) (time.Time, error) {
+	info, err := s.Hot.SampleStat(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	last := info.Modified
+
+	if s.Access != nil {
+		accessed, err := s.Access.SampleAccessGet(id)
+		if err != nil {
+			return last, err
+		}
+		if accessed.After(last) {
+			last = accessed
+		}
+	}
+
+	return last, nil
+}
+
+// move copies a sample to the cold storage and only deletes it from the
+// hot storage once the copy is complete.
+func (s *Tiered) move(id string) error {
+	sample, err := s.Hot.SampleGet(id)
+	if err != nil {
+		return err
+	}
+
+	if err = s.Cold.SampleStore(sample); err != nil {
+		return errors.New("Cold storage: " + err.Error())
+	}
+
+	info, err := s.Cold.SampleStat(id)
+	if err != nil {
+		return errors.New("Cold storage: " + err.Error())
+	}
+	if !info.Exists || info.StoredSize != int64(len(sample.Data)) {
+		return errors.New("Cold storage holds " + strconv.FormatInt(info.StoredSize, 10) + " instead of " + strconv.Itoa(len(sample.Data)) + " bytes")
+	}
+
+	return s.Hot.SampleDelete(sample)
+}
@@ -0,0 +1,161 @@
+package objectStorage
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// memAccessLog remembers the reads in memory.
+type memAccessLog struct {
+	lock     sync.Mutex
+	accessed map[string]time.Time
+}
+
+func (l *memAccessLog) SampleAccessStore(id string, t time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.accessed[id] = t
+	return nil
+}
+
+func (l *memAccessLog) SampleAccessGet(id string) (time.Time, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.accessed[id], nil
+}
+
+// waitAccess waits for the background recording of a read.
+func (l *memAccessLog) waitAccess(t *testing.T, id string) {
+	for i := 0; i < 100; i++ {
+		if accessed, _ := l.SampleAccessGet(id); !accessed.IsZero() {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("read of " + id + " wasn't recorded")
+}
+
+func newTiered(t *testing.T, access AccessLog) (*Tiered, *memStorage, *memStorage) {
+	hot, cold := newMemStorage(), newMemStorage()
+	s := &Tiered{Hot: hot, Cold: cold, MaxIdle: time.Hour, Access: access}
+	if err := s.Initialize(nil); err != nil {
+		t.Fatal(err)
+	}
+	return s, hot, cold
+}
+
+func TestTieredDemotion(t *testing.T) {
+	access := &memAccessLog{accessed: make(map[string]time.Time)}
+	s, hot, cold := newTiered(t, access)
+
+	for _, id := range []string{sampleA, sampleB} {
+		if err := s.SampleStore(&Sample{SHA256: id, Data: []byte(id)}); err != nil {
+			t.Fatal(err)
+		}
+		hot.age(id, time.Hour*2)
+	}
+
+	// sampleB is read recently, so it stays hot
+	if _, err := s.SampleGet(sampleB); err != nil {
+		t.Fatal(err)
+	}
+	access.waitAccess(t, sampleB)
+
+	moved, failed, err := s.Tier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 || len(failed) != 0 {
+		t.Fatalf("moved %d samples, failed %v, expected to move 1", moved, failed)
+	}
+
+	if hot.raw(sampleA) != nil || cold.raw(sampleA) == nil {
+		t.Error("idle sample wasn't moved to the cold storage")
+	}
+	if hot.raw(sampleB) == nil || cold.raw(sampleB) != nil {
+		t.Error("read sample was moved to the cold storage")
+	}
+
+	// nothing left to move
+	if moved, _, _ = s.Tier(); moved != 0 {
+		t.Errorf("moved %d samples again", moved)
+	}
+}
+
+func TestTieredFallthrough(t *testing.T) {
+	s, hot, cold := newTiered(t, nil)
+	cold.SampleStore(&Sample{SHA256: sampleA, Data: []byte("cold")})
+
+	sample, err := s.SampleGet(sampleA)
+	if err != nil || string(sample.Data) != "cold" {
+		t.Errorf("read %v (%v) from the cold storage", sample, err)
+	}
+
+	info, err := s.SampleStat(sampleA)
+	if err != nil || !info.Exists {
+		t.Errorf("cold sample stats as %+v (%v)", info, err)
+	}
+
+	// samples are only read from the cold storage if the hot one lacks them
+	hot.SampleStore(&Sample{SHA256: sampleA, Data: []byte("hot")})
+	if sample, err = s.SampleGet(sampleA); err != nil || string(sample.Data) != "hot" {
+		t.Errorf("read %v (%v), expected the hot copy", sample, err)
+	}
+
+	if _, err = s.SampleGet(sampleB); err == nil {
+		t.Error("unknown sample was found")
+	}
+
+	// the error of the hot storage is reported
+	hot.setDown(true)
+	if _, err = s.SampleGet(sampleB); err != errDown {
+		t.Errorf("got %v, expected the error of the hot storage", err)
+	}
+}
+
+func TestTieredStore(t *testing.T) {
+	s, hot, cold := newTiered(t, nil)
+
+	if err := s.SampleStore(&Sample{SHA256: sampleA, Data: []byte("new")}); err != nil {
+		t.Fatal(err)
+	}
+	if hot.raw(sampleA) == nil || cold.raw(sampleA) != nil {
+		t.Error("new sample wasn't stored in the hot storage")
+	}
+
+	// a sample which moved already is replaced in the cold storage
+	cold.SampleStore(&Sample{SHA256: sampleB, Data: []byte("old")})
+	if err := s.SampleStore(&Sample{SHA256: sampleB, Data: []byte("rewrapped")}); err != nil {
+		t.Fatal(err)
+	}
+	if hot.raw(sampleB) != nil || string(cold.raw(sampleB)) != "rewrapped" {
+		t.Error("moved sample wasn't replaced in the cold storage")
+	}
+
+	if err := s.SampleDelete(&Sample{SHA256: sampleB}); err != nil {
+		t.Fatal(err)
+	}
+	if cold.raw(sampleB) != nil {
+		t.Error("deleted sample is still in the cold storage")
+	}
+}
+
+func TestTieredWithoutAccessLog(t *testing.T) {
+	s, hot, cold := newTiered(t, nil)
+	s.SampleStore(&Sample{SHA256: sampleA, Data: []byte("a")})
+	hot.age(sampleA, time.Hour*2)
+
+	// reads aren't recorded, so the sample is idle since it was stored
+	if _, err := s.SampleGet(sampleA); err != nil {
+		t.Fatal(err)
+	}
+	if moved, _, err := s.Tier(); err != nil || moved != 1 {
+		t.Errorf("moved %d samples (%v), expected 1", moved, err)
+	}
+	if cold.raw(sampleA) == nil {
+		t.Error("sample wasn't moved")
+	}
+}
@@ -0,0 +1,196 @@
+package objectStorage
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Verified wraps another Storage and checks that every sample read still
+// hashes to its sha256, catching bit rot and broken proxies. Mode decides
+// what happens to a mismatching sample: "fail" returns an error, "warn"
+// logs to Warning and returns the sample anyway and "off" skips the check.
+// It has to be the outermost layer, only decoded samples can be hashed.
+//
+// With replication every copy is checked, reads skip corrupt copies and
+// Scrub reports them per replica.
+type Verified struct {
+	Storage Storage
+	Mode    string
+	Warning *log.Logger
+
+	replicated *Replicated
+	decoders   []decoder
+}
+
+// decoder is implemented by layers which transform samples on their way
+// to the storage, like encryption or compression.
+type decoder interface {
+	decode(id string, sample *Sample) error
+}
+
+func (v *Verified) Initialize(c []*Connector) error {
+	if v.Mode != "fail" && v.Mode != "warn" && v.Mode != "off" {
+		return errors.New("Unknown sample verification mode: " + v.Mode)
+	}
+
+	// copies read from a replica have to pass the layers in between,
+	// innermost first, before they can be hashed
+	layers := Layers(v.Storage)
+	for i := len(layers) - 1; i >= 0; i-- {
+		switch layer := layers[i].(type) {
+		case *Replicated:
+			v.replicated = layer
+			v.decoders = nil
+		case decoder:
+			v.decoders = append(v.decoders, layer)
+		}
+	}
+	if v.replicated != nil && v.Mode != "off" {
+		v.replicated.Check = v.check
+	}
+
+	return v.Storage.Initialize(c)
+}
+
+func (v *Verified) Unwrap() Storage {
+	return v.Storage
+}
+
+func (v *Verified) Setup() error {
+	return v.Storage.Setup()
+}
+
+func (v *Verified) Ping() error {
+	return v.Storage.Ping()
+}
+
+func (v *Verified) SampleStore(sample *Sample) error {
+	return v.Storage.SampleStore(sample)
+}
+
+func (v *Verified) SampleGet(id string) (*Sample, error) {
+	sample, err := v.Storage.SampleGet(id)
+	if err != nil || v.Mode == "off" {
+		return sample, err
+	}
+
+	if err = verify(id, sample.Data); err != nil {
+		if v.Mode == "fail" {
+			return sample, err
+		}
+		v.Warning.Println(err.Error())
+	}
+
+	return sample, nil
+}
+
+func (v *Verified) SampleDelete(sample *Sample) error {
+	return v.Storage.SampleDelete(sample)
+}
+
+func (v *Verified) SampleStat(id string) (*SampleInfo, error) {
+	return v.Storage.SampleStat(id)
+}
+
+func (v *Verified) SampleWalk(fn func(string) error) error {
+	return v.Storage.SampleWalk(fn)
+}
+
+// Scrub reads every stored sample and checks its hash, regardless of Mode.
+// It returns the number of checked samples and the errors of the samples
+// which are corrupt (can't be read or decoded) or mismatched (hash to
+// something else).
+//
+// With replication the copy on every replica is checked, the errors of a
+// sample are joined then.
+func (v *Verified) Scrub() (int, map[string]error, error) {
+	checked := 0
+	failed := make(map[string]error)
+
+	err := v.Storage.SampleWalk(func(id string) error {
+		checked++
+
+		if v.replicated != nil {
+			if held, err := v.scrubReplicas(id); held {
+				if err != nil {
+					failed[id] = err
+				}
+				return nil
+			}
+		}
+
+		sample, err := v.Storage.SampleGet(id)
+		if err != nil {
+			failed[id] = errors.New("Sample " + id + " is corrupt: " + err.Error())
+			return nil
+		}
+
+		if err = verify(id, sample.Data); err != nil {
+			failed[id] = err
+		}
+		return nil
+	})
+
+	return checked, failed, err
+}
+
+// scrubReplicas checks the copies of a sample on all replicas holding it.
+// It reports false if no replica holds it, e.g. because it was moved to
+// the cold storage.
+func (v *Verified) scrubReplicas(id string) (bool, error) {
+	held := false
+	errs := v.replicated.each(func(backend Storage) error {
+		info, err := backend.SampleStat(id)
+		if err != nil {
+			return errors.New("Sample " + id + " is corrupt: " + err.Error())
+		}
+		if !info.Exists {
+			return nil
+		}
+		held = true
+
+		sample, err := backend.SampleGet(id)
+		if err != nil {
+			return errors.New("Sample " + id + " is corrupt: " + err.Error())
+		}
+		return v.check(id, sample)
+	})
+
+	msgs := []string{}
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, "Replica "+strconv.Itoa(i)+": "+err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return true, errors.New(strings.Join(msgs, "; "))
+	}
+
+	return held, nil
+}
+
+// check decodes a copy read from a replica and checks its hash, the copy
+// itself is left untouched.
+func (v *Verified) check(id string, sample *Sample) error {
+	decoded := *sample
+	for _, d := range v.decoders {
+		if err := d.decode(id, &decoded); err != nil {
+			return errors.New("Sample " + id + " is corrupt: " + err.Error())
+		}
+	}
+
+	return verify(id, decoded.Data)
+}
+
+func verify(id string, data []byte) error {
+	actual := fmt.Sprintf("%x", sha256.Sum256(data))
+	if actual != strings.ToLower(id) {
+		return errors.New("Sample " + id + " is mismatched, its content hashes to " + actual)
+	}
+
+	return nil
+}
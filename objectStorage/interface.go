@@ -1,5 +1,9 @@
 package objectStorage
 
+import (
+	"time"
+)
+
 /*
 This file contains structs to represent all default
 collections and interfaces.
@@ -17,6 +21,11 @@ type Connector struct {
 	Secret string
 	Bucket string
 	Secure bool
+	Path   string // local-fs only
+
+	// KeyLayout is the template of the keys samples are stored under,
+	// see keyLayout
+	KeyLayout string
 }
 
 type Storage interface {
@@ -28,6 +37,10 @@ type Storage interface {
 	// to create initial collections (if necessary)
 	Setup() error
 
+	// Checks that the storage system is reachable and usable,
+	// called by the readiness check
+	Ping() error
+
 	// Stores a new sample in the database
 	// return "duplicate" error if already known
 	SampleStore(*Sample) error
@@ -38,10 +51,66 @@ type Storage interface {
 
 	// Delete a sample from the database
 	SampleDelete(*Sample) error
+
+	// Gets the metadata of a sample without fetching it,
+	// Exists is false if the sample isn't stored
+	SampleStat(string) (*SampleInfo, error)
+
+	// Calls the function for the sha256 of every stored sample,
+	// stops and returns the error if the function fails
+	SampleWalk(func(string) error) error
+}
+
+// Wrapper is implemented by storages adding a feature on top of another
+// storage, like encryption or compression.
+type Wrapper interface {
+	Unwrap() Storage
+}
+
+// Layers returns the storage followed by all storages it wraps, outermost
+// first.
+func Layers(s Storage) []Storage {
+	layers := []Storage{s}
+	for {
+		w, ok := s.(Wrapper)
+		if !ok {
+			return layers
+		}
+		s = w.Unwrap()
+		layers = append(layers, s)
+	}
 }
 
 // TODO: switch from json to probably raw bytes
 type Sample struct {
 	SHA256 string `json:"sha256"`
 	Data   []byte `json:"data"` //this will result in a base64 encoded string when marshaled
+
+	// Encoding names the codec Data is compressed with, engines have
+	// to store it along with the sample
+	Encoding string `json:"encoding,omitempty"`
+
+	// Size is the size of the original sample. It is set by the layers
+	// changing Data and stored by the engines along with the sample.
+	Size int64 `json:"size,omitempty"`
+
+	// Type is one of SampleTypes, file if empty. Engines may store
+	// samples of different types in different places.
+	Type string `json:"type,omitempty"`
+}
+
+// SampleInfo describes a stored sample. Size is the size of the original
+// sample, StoredSize the size after compression and encryption. Samples
+// stored before sizes were recorded report their stored size as Size.
+type SampleInfo struct {
+	SHA256     string    `json:"sha256"`
+	Exists     bool      `json:"exists"`
+	Size       int64     `json:"size"`
+	StoredSize int64     `json:"stored_size"`
+	Encoding   string    `json:"encoding,omitempty"`
+	Modified   time.Time `json:"modified"`
+
+	// Incomplete is set by Replicated if some replicas don't hold the
+	// sample, storing it again fills the gaps.
+	Incomplete bool `json:"incomplete,omitempty"`
 }
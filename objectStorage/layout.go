@@ -0,0 +1,132 @@
+package objectStorage
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SampleTypes are the types of the stored data: samples of file objects
+// and the payloads of generic objects.
+var SampleTypes = []string{"file", "generic"}
+
+// RelAddress returns the address of a sample relative to the object
+// storage, as recorded by the objects referring to it. Every engine maps
+// it to a key with its own layout.
+func RelAddress(sampleType, sha256 string) string {
+	return sampleType + "/" + sha256
+}
+
+// ParseRelAddress returns the type and sha256 of a relative address.
+func ParseRelAddress(address string) (string, string, error) {
+	i := strings.Index(address, "/")
+	if i < 1 || i == len(address)-1 {
+		return "", "", errors.New("Invalid relative address: " + address)
+	}
+
+	return address[:i], address[i+1:], nil
+}
+
+// keyLayout maps a sample to its key in the storage. Layouts are
+// templates made of "{type}", "{sha256}" and "{sha256:i:j}" (or
+// "{sha256:j}") for a part of the sha256, e.g. "{type}/{sha256:2}/{sha256}".
+// The last part of a key always has to be the sha256.
+type keyLayout struct {
+	template string
+	legacy   string
+}
+
+var layoutToken = regexp.MustCompile(`\{(type|sha256)(?::(\d+))?(?::(\d+))?\}`)
+
+// newKeyLayout checks the template, def is used if it is empty. Samples
+// which were stored with the default layout, before layouts were
+// configurable, are still found if the layout is changed.
+func newKeyLayout(template, def string) (*keyLayout, error) {
+	if template == "" {
+		template = def
+	}
+
+	if template != "{sha256}" && !strings.HasSuffix(template, "/{sha256}") {
+		return nil, errors.New("Key layout " + template + " has to end with /{sha256}")
+	}
+	if strings.Contains(layoutToken.ReplaceAllString(template, ""), "{") {
+		return nil, errors.New("Key layout " + template + " contains an unknown placeholder")
+	}
+
+	l := &keyLayout{template: template}
+	if template != def {
+		l.legacy = def
+	}
+
+	return l, nil
+}
+
+// key returns the key of a sample, the type defaults to file.
+func (l *keyLayout) key(sampleType, sha256 string) string {
+	return expand(l.template, sampleType, sha256)
+}
+
+// sampleKey is a key a sample may be stored under.
+type sampleKey struct {
+	Type string
+	Key  string
+}
+
+// candidates returns the keys a sample may be stored under, the keys of
+// all types in the current layout followed by the default layout.
+func (l *keyLayout) candidates(sha256 string) []sampleKey {
+	var keys []sampleKey
+	seen := make(map[string]bool)
+
+	add := func(sampleType, key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, sampleKey{Type: sampleType, Key: key})
+		}
+	}
+
+	for _, t := range SampleTypes {
+		add(t, l.key(t, sha256))
+	}
+	if l.legacy != "" {
+		add("file", expand(l.legacy, "file", sha256))
+	}
+
+	return keys
+}
+
+// sha256 extracts the sha256 from a key.
+func (l *keyLayout) sha256(key string) string {
+	return key[strings.LastIndex(key, "/")+1:]
+}
+
+func expand(template, sampleType, sha256 string) string {
+	if sampleType == "" {
+		sampleType = "file"
+	}
+
+	return layoutToken.ReplaceAllStringFunc(template, func(token string) string {
+		m := layoutToken.FindStringSubmatch(token)
+		if m[1] == "type" {
+			return sampleType
+		}
+
+		from, to := 0, len(sha256)
+		if m[3] != "" {
+			from, _ = strconv.Atoi(m[2])
+			to, _ = strconv.Atoi(m[3])
+		} else if m[2] != "" {
+			to, _ = strconv.Atoi(m[2])
+		}
+
+		if to > len(sha256) {
+			to = len(sha256)
+		}
+		if from > to {
+			from = to
+		}
+
+		return sha256[from:to]
+	})
+}
@@ -0,0 +1,77 @@
+package objectStorage
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestKeyLayout(t *testing.T) {
+	tests := []struct {
+		template   string
+		sampleType string
+		key        string
+	}{
+		{"", "", testSHA256},
+		{"{sha256}", "generic", testSHA256},
+		{"{type}/{sha256}", "", "file/" + testSHA256},
+		{"{type}/{sha256}", "generic", "generic/" + testSHA256},
+		{"{sha256:2}/{sha256:2:4}/{sha256}", "file", "e3/b0/" + testSHA256},
+		{"{type}/{sha256:0:3}/{sha256}", "file", "file/e3b/" + testSHA256},
+		{"x/{sha256:60:80}/{sha256}", "file", "x/b855/" + testSHA256},
+		{"x/{sha256:10:5}/{sha256}", "file", "x//" + testSHA256},
+	}
+
+	for _, test := range tests {
+		l, err := newKeyLayout(test.template, "{sha256}")
+		if err != nil {
+			t.Errorf("%s: %s", test.template, err.Error())
+			continue
+		}
+		if key := l.key(test.sampleType, testSHA256); key != test.key {
+			t.Errorf("%s: got %s, want %s", test.template, key, test.key)
+		}
+		if sha256 := l.sha256(test.key); sha256 != testSHA256 {
+			t.Errorf("%s: sha256 of %s is %s", test.template, test.key, sha256)
+		}
+	}
+}
+
+func TestKeyLayoutInvalid(t *testing.T) {
+	for _, template := range []string{
+		"{sha256}/x",
+		"{type}",
+		"{md5}/{sha256}",
+		"{sha256:a}/{sha256}",
+	} {
+		if _, err := newKeyLayout(template, "{sha256}"); err == nil {
+			t.Errorf("%s was accepted", template)
+		}
+	}
+}
+
+func TestKeyLayoutCandidates(t *testing.T) {
+	l, err := newKeyLayout("{type}/{sha256}", "{sha256:2}/{sha256}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sampleKey{
+		{"file", "file/" + testSHA256},
+		{"generic", "generic/" + testSHA256},
+		{"file", "e3/" + testSHA256},
+	}
+	if keys := l.candidates(testSHA256); !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+
+	// the default layout has no legacy keys
+	l, err = newKeyLayout("", "{sha256}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := l.candidates(testSHA256); len(keys) != 1 {
+		t.Errorf("got %v, want a single key", keys)
+	}
+}
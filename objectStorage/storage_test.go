@@ -0,0 +1,155 @@
+package objectStorage
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// memStorage keeps samples in memory. It can be taken down to test how
+// the layers on top of it deal with failing engines.
+type memStorage struct {
+	lock    sync.Mutex
+	samples map[string]*Sample
+	stored  map[string]time.Time
+	down    bool
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		samples: make(map[string]*Sample),
+		stored:  make(map[string]time.Time),
+	}
+}
+
+var errDown = errors.New("storage is down")
+
+func (s *memStorage) Initialize([]*Connector) error { return nil }
+
+func (s *memStorage) Setup() error { return nil }
+
+func (s *memStorage) Ping() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.down {
+		return errDown
+	}
+	return nil
+}
+
+func (s *memStorage) SampleStore(sample *Sample) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.down {
+		return errDown
+	}
+	stored := *sample
+	stored.Data = append([]byte{}, sample.Data...)
+	s.samples[sample.SHA256] = &stored
+	s.stored[sample.SHA256] = time.Now()
+	return nil
+}
+
+func (s *memStorage) SampleGet(id string) (*Sample, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.down {
+		return nil, errDown
+	}
+	stored, ok := s.samples[id]
+	if !ok {
+		return nil, errors.New("sample " + id + " not found")
+	}
+	sample := *stored
+	sample.Data = append([]byte{}, stored.Data...)
+	return &sample, nil
+}
+
+func (s *memStorage) SampleDelete(sample *Sample) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.down {
+		return errDown
+	}
+	delete(s.samples, sample.SHA256)
+	delete(s.stored, sample.SHA256)
+	return nil
+}
+
+func (s *memStorage) SampleStat(id string) (*SampleInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.down {
+		return nil, errDown
+	}
+	info := &SampleInfo{SHA256: id}
+	if stored, ok := s.samples[id]; ok {
+		info.Exists = true
+		info.Size = stored.Size
+		info.StoredSize = int64(len(stored.Data))
+		info.Encoding = stored.Encoding
+		info.Modified = s.stored[id]
+	}
+	return info, nil
+}
+
+func (s *memStorage) SampleWalk(fn func(string) error) error {
+	s.lock.Lock()
+	if s.down {
+		s.lock.Unlock()
+		return errDown
+	}
+	ids := make([]string, 0, len(s.samples))
+	for id := range s.samples {
+		ids = append(ids, id)
+	}
+	s.lock.Unlock()
+
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// raw returns the stored bytes of a sample, nil if it isn't stored.
+func (s *memStorage) raw(id string) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if stored, ok := s.samples[id]; ok {
+		return stored.Data
+	}
+	return nil
+}
+
+// setRaw replaces the stored bytes of a sample.
+func (s *memStorage) setRaw(id string, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.samples[id]; !ok {
+		s.samples[id] = &Sample{SHA256: id}
+		s.stored[id] = time.Now()
+	}
+	s.samples[id].Data = data
+}
+
+// age pretends a sample was stored d ago.
+func (s *memStorage) age(id string, d time.Duration) {
+	s.lock.Lock()
+	s.stored[id] = time.Now().Add(-d)
+	s.lock.Unlock()
+}
+
+func (s *memStorage) setDown(down bool) {
+	s.lock.Lock()
+	s.down = down
+	s.lock.Unlock()
+}